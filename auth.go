@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// dummyHashFor returns the hash to compare against when the user is unknown,
+// so a missing user costs the same as a wrong password. It has the cost of
+// ac's hashes, the highest one if they differ, or 10 when there are none.
+func dummyHashFor(ac AuthConfig) string {
+	cost := 0
+	for _, hash := range ac.Users {
+		if c, ok := bcryptCost(hash); ok && c > cost {
+			cost = c
+		}
+	}
+	if cost == 0 {
+		cost = 10
+	}
+	return fmt.Sprintf("$2a$%02d$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy", cost)
+}
+
+// checkAuth enforces HTTP Basic Auth for the most specific protected prefix
+// matching the request path. It reports whether the request may proceed; when
+// it returns false a 401 response has already been written.
+func checkAuth(w http.ResponseWriter, r *http.Request, cfg *Config, errorLogger *log.Logger) bool {
+	_, ac, ok := longestPrefix(cfg.Auth, r.URL.Path)
+	if !ok {
+		return true
+	}
+	user, pass, hasAuth := r.BasicAuth()
+	if hasAuth {
+		hash, known := ac.Users[user]
+		if !known {
+			hash = dummyHashFor(ac)
+		}
+		if bcryptMatches(hash, pass) && known {
+			return true
+		}
+		LogRequestError(errorLogger, r, 401, fmt.Sprintf("auth failed for user %q", user))
+	}
+	realm := ac.Realm
+	if realm == "" {
+		realm = "Restricted"
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+	drainBody(r)
+	serveErrorPage(w, cfg, 401, "401 Unauthorized")
+	return false
+}
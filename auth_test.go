@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Known-answer vectors from OpenBSD's and Openwall's bcrypt test suites.
+var bcryptVectors = []struct {
+	hash, password string
+}{
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK", "U*U*"},
+	{"$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a", "U*U*U"},
+	{"$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui", "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored"},
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy", ""},
+	{"$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+}
+
+func TestBcryptKnownAnswers(t *testing.T) {
+	for _, v := range bcryptVectors {
+		if !bcryptMatches(v.hash, v.password) {
+			t.Errorf("bcryptMatches(%q, %q) = false, want true", v.hash, v.password)
+		}
+		if bcryptMatches(v.hash, "x"+v.password) {
+			t.Errorf("bcryptMatches(%q, %q) = true, want false", v.hash, "x"+v.password)
+		}
+	}
+	for _, hash := range []string{"", "$2a$05$short", "$2c$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "$2a$03$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"} {
+		if bcryptMatches(hash, "U*U") {
+			t.Errorf("bcryptMatches(%q) accepted a malformed hash", hash)
+		}
+	}
+}
+
+func TestDummyHashMatchesConfiguredCost(t *testing.T) {
+	tests := []struct {
+		users map[string]string
+		cost  int
+	}{
+		{nil, 10},
+		{map[string]string{"a": bcryptVectors[0].hash}, 5},
+		{map[string]string{"a": "$2a$12$" + bcryptVectors[0].hash[7:], "b": bcryptVectors[0].hash}, 12},
+		{map[string]string{"a": "not a hash"}, 10},
+	}
+	for _, tt := range tests {
+		hash := dummyHashFor(AuthConfig{Users: tt.users})
+		if cost, ok := bcryptCost(hash); !ok || cost != tt.cost {
+			t.Errorf("dummyHashFor(%v) = %q, want cost %d", tt.users, hash, tt.cost)
+		}
+	}
+}
+
+func TestAuthNestedPrefixes(t *testing.T) {
+	s := testServer(t, `{"auth": {
+		"/a/":   {"realm": "Outer", "users": {"alice": "`+bcryptVectors[0].hash+`"}},
+		"/a/b/": {"realm": "Inner", "users": {"bob": "`+bcryptVectors[1].hash+`"}},
+		"/c/":   {"users": {"alice": "`+bcryptVectors[0].hash+`"}}
+	}}`, map[string]string{"a/x.txt": "x", "a/b/y.txt": "y", "c/z.txt": "z", "open.txt": "o"})
+
+	tests := []struct {
+		target, user, pass string
+		code               int
+		realm              string
+	}{
+		{"/open.txt", "", "", 200, ""},
+		{"/a/x.txt", "", "", 401, "Outer"},
+		{"/a/x.txt", "alice", "U*U", 200, ""},
+		{"/a/x.txt", "alice", "wrong", 401, "Outer"},
+		{"/a/x.txt", "bob", "U*U*", 401, "Outer"},
+		{"/a/b/y.txt", "", "", 401, "Inner"},
+		{"/a/b/y.txt", "alice", "U*U", 401, "Inner"}, // the longest prefix decides alone
+		{"/a/b/y.txt", "bob", "U*U*", 200, ""},
+		{"/c/z.txt", "", "", 401, "Restricted"},
+		{"/c/z.txt", "mallory", "U*U", 401, "Restricted"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s as %q: got %d, want %d", tt.target, tt.user, w.Code, tt.code)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); tt.realm != "" && !strings.Contains(got, `realm="`+tt.realm+`"`) {
+			t.Errorf("%s as %q: WWW-Authenticate %q, want realm %q", tt.target, tt.user, got, tt.realm)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+)
+
+// A minimal bcrypt verifier, so Basic Auth credentials can be stored as
+// standard "$2a$"/"$2b$"/"$2y$" hashes (as produced by htpasswd -B) without
+// pulling in an external module.
+
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+type blowfish struct {
+	p              [18]uint32
+	s0, s1, s2, s3 [256]uint32
+}
+
+func (c *blowfish) f(x uint32) uint32 {
+	return ((c.s0[x>>24] + c.s1[x>>16&0xff]) ^ c.s2[x>>8&0xff]) + c.s3[x&0xff]
+}
+
+func (c *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= c.p[0]
+	for i := 1; i <= 16; i += 2 {
+		r ^= c.f(l) ^ c.p[i]
+		l ^= c.f(r) ^ c.p[i+1]
+	}
+	r ^= c.p[17]
+	return r, l
+}
+
+// streamWord reads the next big-endian word from data, wrapping around.
+func streamWord(data []byte, pos *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(data[*pos])
+		*pos = (*pos + 1) % len(data)
+	}
+	return w
+}
+
+// expandKey is the Blowfish key schedule; salt may be nil for the plain
+// (unsalted) variant used in the expensive bcrypt loop.
+func (c *blowfish) expandKey(key, salt []byte) {
+	pos := 0
+	for i := range c.p {
+		c.p[i] ^= streamWord(key, &pos)
+	}
+	var l, r uint32
+	pos = 0
+	next := func(dst []uint32) {
+		for i := 0; i < len(dst); i += 2 {
+			if salt != nil {
+				l ^= streamWord(salt, &pos)
+				r ^= streamWord(salt, &pos)
+			}
+			l, r = c.encrypt(l, r)
+			dst[i], dst[i+1] = l, r
+		}
+	}
+	next(c.p[:])
+	next(c.s0[:])
+	next(c.s1[:])
+	next(c.s2[:])
+	next(c.s3[:])
+}
+
+// bcryptMatches reports whether password matches the bcrypt hash. The final
+// comparison runs in constant time.
+func bcryptMatches(hash, password string) bool {
+	if len(hash) != 60 || hash[0] != '$' || hash[1] != '2' || hash[3] != '$' || hash[6] != '$' {
+		return false
+	}
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return false
+	}
+	cost, ok := bcryptCost(hash)
+	if !ok {
+		return false
+	}
+	salt, err := bcryptEncoding.DecodeString(hash[7:29])
+	if err != nil || len(salt) != 16 {
+		return false
+	}
+
+	key := append([]byte(password), 0)
+	if len(key) > 72 {
+		key = key[:72]
+	}
+	c := &blowfish{p: blowfishP, s0: blowfishS0, s1: blowfishS1, s2: blowfishS2, s3: blowfishS3}
+	c.expandKey(key, salt)
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
+	}
+
+	text := []byte("OrpheanBeholderScryDoubt")
+	for i := 0; i < len(text); i += 8 {
+		l := binary.BigEndian.Uint32(text[i:])
+		r := binary.BigEndian.Uint32(text[i+4:])
+		for j := 0; j < 64; j++ {
+			l, r = c.encrypt(l, r)
+		}
+		binary.BigEndian.PutUint32(text[i:], l)
+		binary.BigEndian.PutUint32(text[i+4:], r)
+	}
+	computed := hash[:29] + bcryptEncoding.EncodeToString(text[:23])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// bcryptCost returns the cost factor of a bcrypt hash.
+func bcryptCost(hash string) (int, bool) {
+	if len(hash) != 60 || hash[3] != '$' || hash[6] != '$' {
+		return 0, false
+	}
+	cost, err := strconv.Atoi(hash[4:6])
+	if err != nil || cost < 4 || cost > 31 {
+		return 0, false
+	}
+	return cost, true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseCGIResponse splits handler output into a leading CGI header block and
+// the body that follows it. ok is false when the output does not start with
+// a well-formed block of "Key: Value" lines terminated by a blank line.
+func parseCGIResponse(output []byte) (header http.Header, status int, body []byte, ok bool) {
+	header = http.Header{}
+	rest := output
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return nil, 0, output, false
+		}
+		line := strings.TrimSuffix(string(rest[:i]), "\r")
+		rest = rest[i+1:]
+		if line == "" {
+			break
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || !isHeaderName(name) {
+			return nil, 0, output, false
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	if len(header) == 0 {
+		return nil, 0, output, false
+	}
+	if s := header.Get("Status"); s != "" {
+		header.Del("Status")
+		fields := strings.Fields(s)
+		code, err := strconv.Atoi(fields[0])
+		if err != nil || code < 100 || code > 999 {
+			return nil, 0, output, false
+		}
+		status = code
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	return header, status, rest, true
+}
+
+// mayBeCGIHeader reports whether output, the start of a handler's stdout,
+// could still turn out to be a CGI header block as more is written: every
+// complete line so far is a "Key: Value" line and the last, unfinished one
+// starts like one.
+func mayBeCGIHeader(output []byte) bool {
+	rest := output
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(rest[:i]), "\r")
+		if line == "" {
+			return true
+		}
+		name, _, found := strings.Cut(line, ":")
+		if !found || !isHeaderName(name) {
+			return false
+		}
+		rest = rest[i+1:]
+	}
+	name, _, _ := strings.Cut(strings.TrimSuffix(string(rest), "\r"), ":")
+	return name == "" || isHeaderName(name)
+}
+
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// splitScriptPath finds a handler script at the start of urlPath followed by
+// extra path segments, e.g. "/app.php/users/1" gives the script "/app.php"
+// and path info "/users/1". The shortest prefix that is a regular file with a
+// configured handler wins.
+func splitScriptPath(cfg *Config, urlPath string) (scriptFile, scriptName, pathInfo string, handler HandlerConfig, ok bool) {
+	for i := 1; i < len(urlPath); i++ {
+		if urlPath[i] != '/' {
+			continue
+		}
+		prefix := urlPath[:i]
+		h, found := cfg.Handlers[strings.ToLower(path.Ext(prefix))]
+		if !found {
+			continue
+		}
+		file, inside := resolvePath(cfg.HomeDir, (&url.URL{Path: sitePath(cfg, prefix)}).EscapedPath(), cfg.FollowSymlinks)
+		if !inside {
+			return "", "", "", HandlerConfig{}, false
+		}
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			return file, prefix, urlPath[i:], h, true
+		}
+	}
+	return "", "", "", HandlerConfig{}, false
+}
+
+// handlerNotModified reports whether the Last-Modified a handler declared in
+// header is no newer than the request's If-Modified-Since, so the body can be
+// replaced with a 304. If-None-Match takes precedence, as in RFC 9110.
+func handlerNotModified(r *http.Request, header http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMayBeCGIHeader(t *testing.T) {
+	tests := map[string]bool{
+		"":                                 true,
+		"Cont":                             true,
+		"Content-Type: text/pl":            true,
+		"Content-Type: text/plain\r\n":     true,
+		"Content-Type: text/plain\n\nbody": true,
+		"Status: 200 OK\nX-A: b\n":         true,
+		"hello world":                      false,
+		"line one\n":                       false,
+		"Content-Type: text/plain\nbody\n": false,
+		"<html>":                           false,
+		"{\"a\": 1}":                       false,
+	}
+	for in, want := range tests {
+		if got := mayBeCGIHeader([]byte(in)); got != want {
+			t.Errorf("mayBeCGIHeader(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestHandlerIfModifiedSince(t *testing.T) {
+	const page = "printf 'Content-Type: text/plain\\nLast-Modified: Wed, 21 Oct 2015 07:28:00 GMT\\n\\nbody'"
+	s := testServer(t, `{"handlers": {
+		".sh": `+shHandler+`,
+		".st": {"command": "/bin/sh", "args": ["{filepath}"], "stream": true}
+	}}`, map[string]string{"page.sh": page, "page.st": page})
+	tests := []struct {
+		method, ims, inm string
+		code             int
+	}{
+		{"GET", "", "", 200},
+		{"GET", "Wed, 21 Oct 2015 07:28:00 GMT", "", 304},
+		{"GET", "Thu, 22 Oct 2015 00:00:00 GMT", "", 304},
+		{"HEAD", "Wed, 21 Oct 2015 07:28:00 GMT", "", 304},
+		{"GET", "Tue, 20 Oct 2015 00:00:00 GMT", "", 200},
+		{"GET", "not a date", "", 200},
+		// If-None-Match takes precedence, and the handler sent no ETag.
+		{"GET", "Wed, 21 Oct 2015 07:28:00 GMT", `"x"`, 200},
+		{"POST", "Wed, 21 Oct 2015 07:28:00 GMT", "", 200},
+	}
+	for _, target := range []string{"/page.sh", "/page.st"} {
+		for _, tt := range tests {
+			r := httptest.NewRequest(tt.method, target, nil)
+			if tt.ims != "" {
+				r.Header.Set("If-Modified-Since", tt.ims)
+			}
+			if tt.inm != "" {
+				r.Header.Set("If-None-Match", tt.inm)
+			}
+			w := serveRequest(s, r)
+			wantBody := "body"
+			if tt.code == 304 || tt.method == "HEAD" {
+				wantBody = ""
+			}
+			if w.Code != tt.code || w.Body.String() != wantBody {
+				t.Errorf("%s %s If-Modified-Since %q: got %d %q, want %d %q", tt.method, target, tt.ims, w.Code, w.Body.String(), tt.code, wantBody)
+			}
+		}
+	}
+}
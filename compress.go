@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var defaultCompressTypes = []string{
+	"text/html", "text/css", "text/plain", "text/xml",
+	"application/javascript", "text/javascript", "application/json", "image/svg+xml",
+}
+
+// GzipWriter compresses the response body when the response status, type and
+// size qualify. The decision is made once, when the header is written.
+type GzipWriter struct {
+	http.ResponseWriter
+	cfg         *CompressionConfig
+	path        string
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *GzipWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.shouldCompress(code) {
+		h := w.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Add("Vary", "Accept-Encoding")
+		if tag := h.Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+			h.Set("ETag", "W/"+tag) // the encoded body differs from the file
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *GzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(200)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom passes uncompressed responses to the underlying writer's
+// io.ReaderFrom, so static files that aren't compressed keep sendfile.
+func (w *GzipWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			return io.Copy(struct{ io.Writer }{w}, src) // Write sniffs the type
+		}
+		w.WriteHeader(200)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok && w.gz == nil {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{w}, src)
+}
+
+// Close flushes any buffered compressed data. It must be called once the
+// handler has finished writing the response.
+func (w *GzipWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+// Flush sends the data compressed so far down to the client, for responses
+// that are streamed.
+func (w *GzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *GzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *GzipWriter) shouldCompress(code int) bool {
+	h := w.Header()
+	if code != http.StatusOK || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n < w.cfg.MinSize {
+			return false
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if isCompressedType(mediaType) {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(w.path))
+	for _, t := range w.cfg.Types {
+		if strings.HasPrefix(t, ".") {
+			if strings.EqualFold(t, ext) {
+				return true
+			}
+		} else if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressedType reports whether content of this type is already compressed
+// and gains nothing from gzip.
+func isCompressedType(mediaType string) bool {
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2",
+		"application/x-xz", "application/zstd", "application/x-7z-compressed", "application/pdf",
+		"font/woff", "font/woff2":
+		return true
+	}
+	return false
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding allows coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(name, coding) && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"` // exact origins, "*", or wildcards like "https://*.example.com"
+	AllowedMethods   []string `json:"allowed_methods"` // default: GET, HEAD, POST
+	AllowedHeaders   []string `json:"allowed_headers"` // default: echo the preflight's requested headers
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"` // seconds preflight results may be cached
+}
+
+// originAllowed reports whether origin matches one of the allowed entries.
+func originAllowed(allowed []string, origin string) bool {
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+		if scheme, host, ok := strings.Cut(a, "://*."); ok {
+			prefix := strings.ToLower(scheme + "://")
+			rest, found := strings.CutPrefix(strings.ToLower(origin), prefix)
+			if found && strings.HasSuffix(rest, "."+strings.ToLower(host)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleCORS adds CORS headers for an allowed Origin. It reports true when
+// the request was a preflight and a 204 response has been written.
+func handleCORS(w http.ResponseWriter, r *http.Request, cors *CORSConfig) bool {
+	if len(cors.AllowedOrigins) == 0 {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if origin != "" && originAllowed(cors.AllowedOrigins, origin) {
+		if len(cors.AllowedOrigins) == 1 && cors.AllowedOrigins[0] == "*" && !cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			methods := cors.AllowedMethods
+			if len(methods) == 0 {
+				methods = []string{"GET", "HEAD", "POST"}
+			}
+			h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			if len(cors.AllowedHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+			} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+				h.Set("Access-Control-Allow-Headers", req)
+			}
+			if cors.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+			}
+		}
+	}
+	if preflight {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return preflight
+}
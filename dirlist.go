@@ -2,45 +2,365 @@ package main
 
 import (
 	"html/template"
+	"io/fs"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type fileInfo struct {
-	Name   string
-	IsDir  bool
-	Size   int64
-	ModTime string
+	Name      string
+	IsDir     bool
+	Size      int64
+	SizeHuman string
+	ModTime   string
+	MimeType  string // by extension; empty for directories and unknown types
+	Kind      string // folder, image, audio, video, archive, code, document or file
+	URL       string // escaped link to the entry, with a trailing slash for directories
+	modTime   time.Time
+	entry     fs.DirEntry
 }
 
-func RenderDirList(w http.ResponseWriter, r *http.Request, dirPath, urlPath string) {
-	files, err := os.ReadDir(dirPath)
+// stat fills in the fields of fi that need the entry's fs.FileInfo. Listings
+// sorted by name only stat the entries on the page shown. It reports false
+// when the entry can't be stat'ed, e.g. because it was just removed.
+func (fi *fileInfo) stat() bool {
+	info, err := fi.entry.Info()
+	if err != nil {
+		return false
+	}
+	fi.Size = info.Size()
+	fi.SizeHuman = humanSize(info.Size())
+	fi.ModTime = info.ModTime().Format("2006-01-02 15:04:05")
+	fi.modTime = info.ModTime()
+	return true
+}
+
+// fileKinds maps extensions to the Kind shown in listings for types that the
+// MIME type alone doesn't classify well.
+var fileKinds = map[string]string{
+	".zip": "archive", ".tar": "archive", ".gz": "archive", ".tgz": "archive",
+	".bz2": "archive", ".xz": "archive", ".7z": "archive", ".rar": "archive", ".zst": "archive",
+	".go": "code", ".js": "code", ".ts": "code", ".py": "code", ".rb": "code", ".php": "code",
+	".c": "code", ".h": "code", ".cpp": "code", ".rs": "code", ".java": "code", ".sh": "code",
+	".css": "code", ".json": "code", ".xml": "code", ".yaml": "code", ".yml": "code", ".html": "code", ".htm": "code",
+	".pdf": "document", ".txt": "document", ".md": "document", ".doc": "document", ".docx": "document",
+	".odt": "document", ".rtf": "document", ".xls": "document", ".xlsx": "document", ".ppt": "document", ".pptx": "document",
+	".csv": "document",
+}
+
+// fileKind classifies a listing entry from its extension, falling back to the
+// MIME type's top-level type.
+func fileKind(name, mimeType string, isDir bool) string {
+	if isDir {
+		return "folder"
+	}
+	if kind, ok := fileKinds[strings.ToLower(filepath.Ext(name))]; ok {
+		return kind
+	}
+	major, _, _ := strings.Cut(mimeType, "/")
+	switch major {
+	case "image", "audio", "video":
+		return major
+	case "text":
+		return "document"
+	}
+	return "file"
+}
+
+// humanSize formats n bytes using binary units, e.g. "1.5 KB".
+func humanSize(n int64) string {
+	if n < 1024 {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	units := []string{"KB", "MB", "GB", "TB", "PB"}
+	f := float64(n) / 1024
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return strconv.FormatFloat(f, 'f', 1, 64) + " " + units[i]
+}
+
+// sortFileInfos orders infos by key ("name", "size" or "date"), optionally
+// descending, keeping directories ahead of files when dirsFirst is set.
+func sortFileInfos(infos []fileInfo, key string, desc, dirsFirst bool) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if dirsFirst && a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch key {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "date":
+			if !a.modTime.Equal(b.modTime) {
+				return a.modTime.Before(b.modTime)
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+// autoIndexEnabled reports whether a listing may be shown for urlPath: the
+// longest matching auto_index_paths prefix decides, then auto_index, which
+// defaults to true.
+func autoIndexEnabled(cfg *Config, urlPath string) bool {
+	if _, on, ok := longestPrefix(cfg.AutoIndexPaths, urlPath); ok {
+		return on
+	}
+	return cfg.AutoIndex == nil || *cfg.AutoIndex
+}
+
+type breadcrumb struct {
+	Name string
+	URL  string
+}
+
+// breadcrumbs splits urlPath into links for each ancestor directory, starting
+// with the root ("Home").
+func breadcrumbs(urlPath string) []breadcrumb {
+	crumbs := []breadcrumb{{Name: "Home", URL: "/"}}
+	href := "/"
+	for _, seg := range strings.Split(strings.Trim(urlPath, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+		href += url.PathEscape(seg) + "/"
+		crumbs = append(crumbs, breadcrumb{Name: seg, URL: href})
+	}
+	return crumbs
+}
+
+// dirTemplateName is the per-directory listing template, checked before
+// Config.DirListTemplate. Being a dotfile it never shows up in the listing.
+const dirTemplateName = ".dirlist.html"
+
+var fallbackDirTemplate = template.Must(template.New("dir").Parse(`<html><head><title>{{.Title}}</title></head><body><h1>{{.Title}}</h1>{{.Header}}<ul>{{if .Parent}}<li><a href="{{.Parent}}">..</a></li>{{end}}{{range .Files}}<li><a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a></li>{{end}}</ul>{{if .PrevURL}}<a href="{{.PrevURL}}">Previous</a> {{end}}{{if .NextURL}}<a href="{{.NextURL}}">Next</a>{{end}}{{.Footer}}</body></html>`))
+
+type cachedTemplate struct {
+	modTime time.Time
+	tmpl    *template.Template // nil when the file failed to parse
+}
+
+// dirTemplates caches parsed listing templates by path, each valid for the
+// modification time it was parsed at. Only files that exist are cached, so
+// directories without a template of their own add nothing. Entries are kept
+// until resetDirTemplates, or in dev mode until the file changes or goes.
+var (
+	dirTemplatesMu sync.Mutex
+	dirTemplates   = make(map[string]cachedTemplate)
+)
+
+// loadTemplate returns the listing template at path, parsing it only the
+// first time (or, when recheck is set, after the file changes). Parse errors
+// are logged once per version of the file. ok is false when the file is
+// missing or invalid.
+func loadTemplate(path string, recheck bool, errorLogger *log.Logger) (*template.Template, bool) {
+	if path == "" {
+		return nil, false
+	}
+	dirTemplatesMu.Lock()
+	c, cached := dirTemplates[path]
+	dirTemplatesMu.Unlock()
+	if cached && !recheck {
+		return c.tmpl, c.tmpl != nil
+	}
+	// Stat and parse without the lock, so listings elsewhere don't wait.
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		if cached {
+			dirTemplatesMu.Lock()
+			delete(dirTemplates, path)
+			dirTemplatesMu.Unlock()
+		}
+		return nil, false
+	}
+	if cached && c.modTime.Equal(info.ModTime()) {
+		return c.tmpl, c.tmpl != nil
+	}
+	content, err := os.ReadFile(path)
+	var t *template.Template
+	if err == nil {
+		t, err = template.New("dir").Parse(string(content))
+	}
+	if err != nil {
+		t = nil
+		if errorLogger != nil {
+			errorLogger.Printf("directory listing template %s: %v; falling back", path, err)
+		}
+	}
+	dirTemplatesMu.Lock()
+	dirTemplates[path] = cachedTemplate{modTime: info.ModTime(), tmpl: t}
+	dirTemplatesMu.Unlock()
+	return t, t != nil
+}
+
+// resetDirTemplates drops every cached template so the next listing reads
+// them again.
+func resetDirTemplates() {
+	dirTemplatesMu.Lock()
+	clear(dirTemplates)
+	dirTemplatesMu.Unlock()
+}
+
+// listingTitle returns the page title for the listing of urlPath.
+func listingTitle(cfg *Config, urlPath string) string {
+	title := cfg.ListingTitle
+	if title == "" {
+		title = "Index of {path}"
+	}
+	return strings.ReplaceAll(title, "{path}", urlPath)
+}
+
+// RenderDirList writes the listing for the directory at urlPath. dirPath
+// is the directory on disk, used to find a per-directory template; it is
+// empty for an embedded site.
+func RenderDirList(w http.ResponseWriter, r *http.Request, site FileSystem, dirPath, urlPath string, cfg *Config, errorLogger *log.Logger) {
+	dir := sitePath(cfg, urlPath)
+	files, err := site.ReadDir(dir)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte("Failed to read directory."))
 		return
 	}
+	// Hidden columns are blanked so no template can show them, and can't be
+	// sorted on either, since the order would give them away.
+	showSize := cfg.ListingShowSize == nil || *cfg.ListingShowSize
+	showModTime := cfg.ListingShowModTime == nil || *cfg.ListingShowModTime
+	sortKey := r.URL.Query().Get("sort")
+	if (sortKey != "size" || !showSize) && (sortKey != "date" || !showModTime) {
+		sortKey = "name"
+	}
+	order := r.URL.Query().Get("order")
+	if order != "desc" {
+		order = "asc"
+	}
+	ignored := ignoreRulesFor(site, dir)
 	var infos []fileInfo
 	for _, f := range files {
-		info, _ := f.Info()
-		infos = append(infos, fileInfo{
-			Name:   f.Name(),
-			IsDir:  f.IsDir(),
-			Size:   info.Size(),
-			ModTime: info.ModTime().Format("2006-01-02 15:04:05"),
-		})
-	}
-	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
-	tmplPath := "html/dirlist.html"
-	tmplContent, err := os.ReadFile(tmplPath)
+		if isHiddenName(cfg, f.Name()) || ignored.ignores(path.Join(dir, f.Name())) {
+			continue
+		}
+		var mimeType string
+		if !f.IsDir() {
+			mimeType = mimeOverride(cfg.MimeTypes, f.Name())
+			if mimeType == "" {
+				mimeType = mime.TypeByExtension(filepath.Ext(f.Name()))
+			}
+		}
+		fi := fileInfo{
+			Name:     f.Name(),
+			IsDir:    f.IsDir(),
+			MimeType: mimeType,
+			Kind:     fileKind(f.Name(), mimeType, f.IsDir()),
+			entry:    f,
+		}
+		if sortKey != "name" && !fi.stat() {
+			continue
+		}
+		infos = append(infos, fi)
+	}
+	sortFileInfos(infos, sortKey, order == "desc", cfg.DirsFirst)
+	page, totalPages, start, end := listingPage(r, len(infos), cfg.ListingPageSize)
+	infos = infos[start:end]
+	if sortKey == "name" {
+		kept := infos[:0]
+		for _, fi := range infos {
+			if fi.stat() {
+				kept = append(kept, fi)
+			}
+		}
+		infos = kept
+	}
+	crumbs := breadcrumbs(urlPath)
+	parent := ""
+	if len(crumbs) > 1 {
+		parent = crumbs[len(crumbs)-2].URL
+	}
+	dirURL := crumbs[len(crumbs)-1].URL
+	for i := range infos {
+		if !showSize {
+			infos[i].Size, infos[i].SizeHuman = 0, ""
+		}
+		if !showModTime {
+			infos[i].ModTime, infos[i].modTime = "", time.Time{}
+		}
+		infos[i].URL = dirURL + url.PathEscape(infos[i].Name)
+		if infos[i].IsDir {
+			infos[i].URL += "/"
+		}
+	}
 	var t *template.Template
-	if err == nil {
-		t, err = template.New("dir").Parse(string(tmplContent))
+	ok := false
+	if dirPath != "" {
+		t, ok = loadTemplate(filepath.Join(dirPath, dirTemplateName), cfg.DevMode, errorLogger)
+	}
+	if !ok {
+		t, ok = loadTemplate(cfg.DirListTemplate, cfg.DevMode, errorLogger)
+	}
+	if !ok {
+		t = fallbackDirTemplate
+	}
+	_ = t.Execute(w, map[string]any{"Path": urlPath, "Files": infos, "Prefix": template.URLQueryEscaper(urlPath), "Sort": sortKey, "Order": order, "Breadcrumbs": crumbs, "Parent": parent, "ShowSize": showSize, "ShowModTime": showModTime,
+		"Title": listingTitle(cfg, urlPath), "Header": template.HTML(cfg.ListingHeaderHTML), "Footer": template.HTML(cfg.ListingFooterHTML),
+		"Page": page, "TotalPages": totalPages, "PrevURL": listingPageURL(r, page-1, totalPages), "NextURL": listingPageURL(r, page+1, totalPages)})
+}
+
+// defaultListingPageSize is the number of entries per listing page when
+// listing_page_size is 0.
+const defaultListingPageSize = 1000
+
+// listingPage picks the page of a listing of n entries that r asks for with
+// ?page=N, counting from 1. A missing or invalid page is the first, one past
+// the end the last. size is listing_page_size. It returns the bounds of the
+// page in the sorted entries.
+func listingPage(r *http.Request, n, size int) (page, totalPages, start, end int) {
+	if size == 0 {
+		size = defaultListingPageSize
+	}
+	if size < 0 || n <= size {
+		return 1, 1, 0, n
+	}
+	totalPages = (n + size - 1) / size
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	page = min(page, totalPages)
+	start = (page - 1) * size
+	return page, totalPages, start, min(start+size, n)
+}
+
+// listingPageURL is the relative link to page of the listing r is for,
+// keeping its other query parameters such as sort and order. It is empty
+// when there is no such page.
+func listingPageURL(r *http.Request, page, totalPages int) string {
+	if page < 1 || page > totalPages {
+		return ""
 	}
-	if err != nil || t == nil {
-		// fallback to built-in minimal template
-		t, _ = template.New("dir").Parse(`<html><head><title>Index of {{.Path}}</title></head><body><h1>Index of {{.Path}}</h1><ul>{{range .Files}}<li><a href="{{$.Prefix}}{{.Name}}{{if .IsDir}}/{{end}}">{{.Name}}{{if .IsDir}}/{{end}}</a></li>{{end}}</ul></body></html>`)
+	q := r.URL.Query()
+	q.Del("page")
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page))
 	}
-	_ = t.Execute(w, map[string]any{"Path": urlPath, "Files": infos, "Prefix": template.URLQueryEscaper(urlPath)})
-} 
\ No newline at end of file
+	if len(q) == 0 {
+		return "./"
+	}
+	return "?" + q.Encode()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirTemplatesCacheOnlyExistingFiles(t *testing.T) {
+	resetDirTemplates()
+	defer resetDirTemplates()
+	s := testServer(t, `{"dirlist_template": "/nonexistent/dirlist.html"}`, map[string]string{
+		"a/x.txt": "", "b/x.txt": "", "c/x.txt": "",
+		"t/.dirlist.html": "custom {{.Title}}",
+	})
+	for _, target := range []string{"/a/", "/b/", "/c/", "/t/"} {
+		if code := serve(s, "GET", target).Code; code != 200 {
+			t.Fatalf("%s: got %d", target, code)
+		}
+	}
+	dirTemplatesMu.Lock()
+	n := len(dirTemplates)
+	dirTemplatesMu.Unlock()
+	if n != 1 {
+		t.Errorf("%d templates cached after listing 3 directories without one, want 1", n)
+	}
+	if body := serve(s, "GET", "/t/").Body.String(); !strings.HasPrefix(body, "custom") {
+		t.Errorf("/t/: got %q, want the directory's template", body)
+	}
+}
+
+func TestLoadTemplateRecheck(t *testing.T) {
+	resetDirTemplates()
+	defer resetDirTemplates()
+	p := filepath.Join(t.TempDir(), "dirlist.html")
+	if err := os.WriteFile(p, []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	render := func(recheck bool) string {
+		tmpl, ok := loadTemplate(p, recheck, nil)
+		if !ok {
+			return ""
+		}
+		var b strings.Builder
+		tmpl.Execute(&b, nil)
+		return b.String()
+	}
+	if got := render(false); got != "one" {
+		t.Fatalf("got %q, want one", got)
+	}
+	os.WriteFile(p, []byte("two"), 0644)
+	os.Chtimes(p, time.Now(), time.Now().Add(time.Hour))
+	if got := render(false); got != "one" {
+		t.Errorf("without recheck: got %q, want the cached one", got)
+	}
+	if got := render(true); got != "two" {
+		t.Errorf("with recheck: got %q, want two", got)
+	}
+	os.Remove(p)
+	if got := render(true); got != "" {
+		t.Errorf("removed template still used: %q", got)
+	}
+	if _, ok := dirTemplates[p]; ok {
+		t.Error("removed template is still cached")
+	}
+}
+
+func TestListingEscapesFileNames(t *testing.T) {
+	s := testServer(t, `{"dirlist_template": "/nonexistent/dirlist.html"}`, map[string]string{
+		"files/a b#c.txt": "abc",
+		"files/q?.txt":    "q",
+		"files/<b>.txt":   "b",
+		"files/d e/x":     "",
+	})
+	body := serve(s, "GET", "/files/").Body.String()
+	for _, want := range []string{
+		`href="/files/a%20b%23c.txt"`, `>a b#c.txt<`,
+		`href="/files/q%3F.txt"`,
+		`href="/files/%3Cb%3E.txt"`, `&lt;b&gt;.txt`,
+		`href="/files/d%20e/"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing lacks %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "<b>.txt") {
+		t.Error("file name is not HTML-escaped")
+	}
+	// The links lead back to the files.
+	for target, want := range map[string]string{"/files/a%20b%23c.txt": "abc", "/files/q%3F.txt": "q"} {
+		if w := serve(s, "GET", target); w.Code != 200 || w.Body.String() != want {
+			t.Errorf("%s: got %d %q, want %q", target, w.Code, w.Body.String(), want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// handlerRegistry tracks running handler processes so shutdown can wait for
+// them instead of orphaning them mid-response.
+type handlerRegistry struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	cmds     map[*exec.Cmd]struct{}
+	draining bool // set by drain; run starts nothing after it
+}
+
+// errDraining is what run returns once drain has been called.
+var errDraining = errors.New("handlers are draining for shutdown")
+
+var runningHandlers = &handlerRegistry{cmds: make(map[*exec.Cmd]struct{})}
+
+// run starts cmd and waits for it, keeping it registered while it runs. The
+// lock isn't held across Start, since fork/exec is slow and would serialise
+// every handler spawn; the WaitGroup is counted first, under the lock, so
+// that drain already waits for a process that is still starting and no Add
+// races with its Wait.
+func (h *handlerRegistry) run(cmd *exec.Cmd) error {
+	h.mu.Lock()
+	if h.draining {
+		h.mu.Unlock()
+		return errDraining
+	}
+	h.wg.Add(1)
+	h.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		h.wg.Done()
+		return err
+	}
+	h.mu.Lock()
+	h.cmds[cmd] = struct{}{}
+	h.mu.Unlock()
+
+	err := cmd.Wait()
+
+	h.mu.Lock()
+	delete(h.cmds, cmd)
+	h.mu.Unlock()
+	h.wg.Done()
+	return err
+}
+
+// drain waits for running handlers to finish, refusing new ones. When ctx expires first, the
+// remaining processes are sent SIGTERM; drain reports how many were left.
+func (h *handlerRegistry) drain(ctx context.Context) int {
+	h.mu.Lock()
+	h.draining = true
+	h.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for cmd := range h.cmds {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	return len(h.cmds)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandlerRegistryRunsConcurrently(t *testing.T) {
+	h := &handlerRegistry{cmds: make(map[*exec.Cmd]struct{})}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.run(exec.Command("sleep", "0.3")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("4 handlers of 0.3s took %s", d)
+	}
+	if err := h.run(exec.Command("/nonexistent/handler")); err == nil {
+		t.Error("starting a missing command succeeded")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if left := h.drain(ctx); left != 0 || len(h.cmds) != 0 {
+		t.Errorf("drain left %d handlers, %d registered", left, len(h.cmds))
+	}
+}
+
+func TestHandlerRegistryRefusesWorkOnceDraining(t *testing.T) {
+	h := &handlerRegistry{cmds: make(map[*exec.Cmd]struct{})}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				h.run(exec.Command("true"))
+			}
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.drain(ctx)
+	wg.Wait()
+	if err := h.run(exec.Command("true")); !errors.Is(err, errDraining) {
+		t.Errorf("run after drain: got %v, want errDraining", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !embedsite
+
+package main
+
+import "embed"
+
+// embeddedSite is empty unless the binary is built with -tags embedsite.
+var embeddedSite embed.FS
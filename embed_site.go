@@ -0,0 +1,11 @@
+//go:build embedsite
+
+package main
+
+import "embed"
+
+// embeddedSite holds the site/ directory, compiled in with -tags embedsite
+// and served when HomeDir is "embed:".
+//
+//go:embed all:site
+var embeddedSite embed.FS
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultETagHashLimit = 10 << 20
+	maxETagCacheEntries  = 4096
+)
+
+type etagKey struct {
+	site    FileSystem
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+var (
+	etagCacheMu sync.Mutex
+	etagCache   = make(map[etagKey]string)
+)
+
+// fileETag returns a strong ETag for the file name in site. Files up to
+// hashLimit bytes are identified by a SHA-256 of their content; larger ones by
+// size and modification time. Results are cached until the file changes.
+func fileETag(site FileSystem, name string, info fs.FileInfo, hashLimit int64) (string, error) {
+	key := etagKey{site: site, path: name, modTime: info.ModTime(), size: info.Size()}
+	etagCacheMu.Lock()
+	tag, ok := etagCache[key]
+	etagCacheMu.Unlock()
+	if ok {
+		return tag, nil
+	}
+
+	if info.Size() > hashLimit {
+		tag = `"` + strconv.FormatInt(info.Size(), 16) + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 16) + `"`
+	} else {
+		f, err := site.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		tag = `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	}
+
+	etagCacheMu.Lock()
+	if len(etagCache) >= maxETagCacheEntries {
+		etagCache = make(map[etagKey]string)
+	}
+	etagCache[key] = tag
+	etagCacheMu.Unlock()
+	return tag, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types and constants (FastCGI specification, section 8).
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiKeepConn     = 1
+	fcgiMaxContent   = 65535
+	fcgiRequestID    = 1 // one request at a time per connection
+	fcgiMaxIdle      = 8 // idle connections kept per backend
+)
+
+// fcgiPool keeps idle connections to FastCGI backends so requests don't pay
+// for a new connection each time.
+type fcgiPool struct {
+	mu   sync.Mutex
+	idle map[string][]net.Conn
+}
+
+var fastcgiConns = &fcgiPool{idle: make(map[string][]net.Conn)}
+
+// fcgiDial connects to address, which is either "unix:/path/to/socket", an
+// absolute socket path, or a TCP "host:port", giving up when ctx is done.
+func fcgiDial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	network := "tcp"
+	if rest, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", rest
+	} else if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return (&net.Dialer{Timeout: timeout}).DialContext(ctx, network, address)
+}
+
+func (p *fcgiPool) get(ctx context.Context, address string, timeout time.Duration) (conn net.Conn, reused bool, err error) {
+	p.mu.Lock()
+	if conns := p.idle[address]; len(conns) > 0 {
+		conn = conns[len(conns)-1]
+		p.idle[address] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		return conn, true, nil
+	}
+	p.mu.Unlock()
+	conn, err = fcgiDial(ctx, address, timeout)
+	return conn, false, err
+}
+
+func (p *fcgiPool) put(address string, conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[address]) >= fcgiMaxIdle {
+		conn.Close()
+		return
+	}
+	p.idle[address] = append(p.idle[address], conn)
+}
+
+// countingReader records whether anything has been read from the request
+// body, which decides if a failed request can be retried on a new connection.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fastcgiRoundTrip sends one request to the FastCGI backend at address,
+// copying what it writes to stdout as it arrives, and returns what it wrote
+// to stderr. env holds the CGI parameters as "NAME=value" strings. timeout
+// bounds the whole exchange; 0 means no limit. When ctx is done first, e.g.
+// because the client went away, the connection is closed and ctx's error
+// returned.
+func fastcgiRoundTrip(ctx context.Context, address string, env []string, body io.Reader, stdout io.Writer, timeout time.Duration) (stderr []byte, err error) {
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	cr := &countingReader{r: body}
+	cw := &countingWriter{w: stdout}
+	for {
+		conn, reused, err := fastcgiConns.get(ctx, address, timeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if timeout > 0 {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		stderr, err = fcgiExchange(conn, env, cr, cw)
+		if !stop() {
+			// conn has been closed under the exchange.
+			return stderr, ctx.Err()
+		}
+		if err == nil {
+			fastcgiConns.put(address, conn)
+			return stderr, nil
+		}
+		conn.Close()
+		// A pooled connection may have been closed by the backend while it
+		// sat idle; retry once on a fresh one if nothing has been read from
+		// the body or written to stdout yet.
+		var nerr net.Error
+		if !reused || cr.n > 0 || cw.n > 0 || (errors.As(err, &nerr) && nerr.Timeout()) {
+			return stderr, err
+		}
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func fcgiExchange(conn net.Conn, env []string, body io.Reader, stdout io.Writer) (stderr []byte, err error) {
+	w := bufio.NewWriter(conn)
+	begin := [8]byte{0, fcgiResponder, fcgiKeepConn}
+	if err := fcgiWriteRecord(w, fcgiBeginRequest, begin[:]); err != nil {
+		return nil, err
+	}
+	var params bytes.Buffer
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		fcgiWriteLength(&params, len(name))
+		fcgiWriteLength(&params, len(value))
+		params.WriteString(name)
+		params.WriteString(value)
+	}
+	if err := fcgiWriteStream(w, fcgiParams, params.Bytes()); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, fcgiMaxContent)
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			if err := fcgiWriteRecord(w, fcgiStdin, buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+	if err := fcgiWriteRecord(w, fcgiStdin, nil); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var errOut bytes.Buffer
+	r := bufio.NewReader(conn)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		content := make([]byte, length+int(header[6]))
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, err
+		}
+		content = content[:length]
+		switch header[1] {
+		case fcgiStdout:
+			if _, err := stdout.Write(content); err != nil {
+				return errOut.Bytes(), err
+			}
+		case fcgiStderr:
+			errOut.Write(content)
+		case fcgiEndRequest:
+			if length >= 5 && content[4] != 0 {
+				return nil, fmt.Errorf("fastcgi: request rejected (protocol status %d)", content[4])
+			}
+			return errOut.Bytes(), nil
+		}
+	}
+}
+
+// fcgiWriteStream writes data as a sequence of records of type typ, followed
+// by the empty record that ends the stream.
+func fcgiWriteStream(w io.Writer, typ byte, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), fcgiMaxContent)
+		if err := fcgiWriteRecord(w, typ, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return fcgiWriteRecord(w, typ, nil)
+}
+
+func fcgiWriteRecord(w io.Writer, typ byte, content []byte) error {
+	padding := -len(content) & 7
+	header := [8]byte{fcgiVersion, typ, 0, fcgiRequestID, 0, 0, byte(padding)}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// fcgiWriteLength encodes a name-value pair length: one byte below 128,
+// otherwise four bytes with the high bit set.
+func fcgiWriteLength(b *bytes.Buffer, n int) {
+	if n < 128 {
+		b.WriteByte(byte(n))
+		return
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(n)|1<<31)
+	b.Write(l[:])
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFastCGIRoundTripStopsWithContext(t *testing.T) {
+	// A backend that accepts and never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = fastcgiRoundTrip(ctx, ln.Addr().String(), []string{"REQUEST_METHOD=GET"}, nil, io.Discard, time.Minute)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("round trip took %v after the context was cancelled", d)
+	}
+}
+
+// fakeFastCGI serves FastCGI requests on a local listener, answering each
+// with the stdout chunks given, pausing between them, and returns its
+// address.
+func fakeFastCGI(t *testing.T, pause time.Duration, chunks ...string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					// Read the request up to the empty stdin record.
+					var header [8]byte
+					if _, err := io.ReadFull(r, header[:]); err != nil {
+						return
+					}
+					length := int(binary.BigEndian.Uint16(header[4:6]))
+					if _, err := io.ReadFull(r, make([]byte, length+int(header[6]))); err != nil {
+						return
+					}
+					if header[1] != fcgiStdin || length != 0 {
+						continue
+					}
+					for i, chunk := range chunks {
+						if i > 0 {
+							time.Sleep(pause)
+						}
+						if fcgiWriteRecord(conn, fcgiStdout, []byte(chunk)) != nil {
+							return
+						}
+					}
+					fcgiWriteRecord(conn, fcgiStdout, nil)
+					fcgiWriteRecord(conn, fcgiEndRequest, make([]byte, 8))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestFastCGIOutputIsStreamed(t *testing.T) {
+	streamed := fakeFastCGI(t, 2*time.Second, "Content-Type: text/plain\r\n\r\nfirst\n", "second\n")
+	large := fakeFastCGI(t, 0, "Content-Type: text/plain\r\n\r\n", strings.Repeat("x", 100), strings.Repeat("y", 100))
+	s := testServer(t, `{
+		"handler_buffer_size": 64,
+		"handlers": {
+			".php": {"type": "fastcgi", "address": "`+streamed+`", "stream": true},
+			".fcgi": {"type": "fastcgi", "address": "`+large+`"}
+		}
+	}`, map[string]string{"a.php": "", "a.fcgi": ""})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := http.Get(ts.URL + "/a.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	resp.Body.Close()
+	if err != nil || line != "first\n" {
+		t.Fatalf("got %q, %v, want the first line", line, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("first line took %s, so the output was buffered", d)
+	}
+
+	// Output past handler_buffer_size goes out without a Content-Length.
+	w := serve(s, "GET", "/a.fcgi")
+	if w.Code != 200 || w.Body.String() != strings.Repeat("x", 100)+strings.Repeat("y", 100) {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("streamed output has Content-Length %s", cl)
+	}
+}
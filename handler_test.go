@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArgsRefuseOptionsFromRequest(t *testing.T) {
+	s := testServer(t, `{"handlers": {".sh": {"command": "/bin/echo", "args": ["{query}", "-n", "--q={query}"]}}}`,
+		map[string]string{"a.sh": ""})
+	tests := []struct {
+		target  string
+		refused bool
+	}{
+		{"/a.sh?x=1", false},
+		{"/a.sh?-rf", true},
+		{"/a.sh?--help", true},
+		{"/a.sh?x=-1", false},
+	}
+	for _, tt := range tests {
+		code := serve(s, "GET", tt.target).Code
+		if (code == 400) != tt.refused {
+			t.Errorf("%s: got %d, refused should be %v", tt.target, code, tt.refused)
+		}
+	}
+}
+
+func TestMaxConcurrentIsPerRoute(t *testing.T) {
+	s := testServer(t, `{
+		"queue_timeout": 1,
+		"handlers": {
+			".a": {"command": "/bin/sh", "args": ["{filepath}"], "max_concurrent": 1},
+			".b": {"command": "/bin/sh", "args": ["{filepath}"], "max_concurrent": 1},
+			".c": {"command": "/bin/sh", "args": ["{filepath}"], "max_concurrent": 3}
+		}
+	}`, map[string]string{
+		"x.a": "printf 'Content-Type: text/plain\\n\\na'",
+		"x.b": "printf 'Content-Type: text/plain\\n\\nb'",
+		"x.c": "printf 'Content-Type: text/plain\\n\\nc'",
+	})
+	// Fill .a's only slot.
+	sem := getSemaphore("handler:.a", 1)
+	sem.tryAcquire()
+	defer sem.release()
+
+	for target, want := range map[string]int{"/x.a": 503, "/x.b": 200, "/x.c": 200} {
+		if code := serve(s, "GET", target).Code; code != want {
+			t.Errorf("%s: got %d, want %d", target, code, want)
+		}
+	}
+	// Using .c didn't replace .a's semaphore, so its slot is still taken.
+	if code := serve(s, "GET", "/x.a").Code; code != 503 {
+		t.Errorf("/x.a after /x.c: got %d, want 503", code)
+	}
+}
+
+func TestStreamWithoutHeaderBlockIsSentIncrementally(t *testing.T) {
+	s := testServer(t, `{"handlers": {".sh": {"command": "/bin/sh", "args": ["{filepath}"], "stream": true}}}`,
+		map[string]string{"tick.sh": "echo 'first line'; sleep 2; echo 'second line'"})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := http.Get(ts.URL + "/tick.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "first line\n" {
+		t.Errorf("got %q, want the first line", line)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("first line took %s, so the output was buffered", d)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct == "" {
+		t.Error("no default Content-Type")
+	}
+}
+
+func TestPathTranslatedUnderMount(t *testing.T) {
+	home, mountRoot := t.TempDir(), t.TempDir()
+	top := &Config{HomeDir: home, Mounts: map[string]Mount{"/m/": {Root: mountRoot}}}
+	tests := []struct {
+		urlPath, pathInfo, want string
+	}{
+		{"/app.php/users/1", "/users/1", filepath.Join(home, "users", "1")},
+		{"/m/app.php/m/docs/a", "/m/docs/a", filepath.Join(mountRoot, "docs", "a")},
+	}
+	for _, tt := range tests {
+		cfg := mountConfig(top, tt.urlPath)
+		r := httptest.NewRequest("GET", tt.urlPath, nil)
+		env := cgiEnv(r, cfg, filepath.Join(cfg.HomeDir, "app.php"), "/app.php", tt.pathInfo)
+		if !slices.Contains(env, "PATH_TRANSLATED="+tt.want) {
+			t.Errorf("%s: PATH_TRANSLATED not %s in %v", tt.urlPath, tt.want, env)
+		}
+	}
+}
+
+// envScript is a handler script that answers with its environment.
+const envScript = "printf 'Content-Type: text/plain\\n\\n'; env"
+
+// handlerEnv runs target on s and returns the environment envScript saw.
+func handlerEnv(t *testing.T, s *Server, r *http.Request) map[string]string {
+	t.Helper()
+	w := serveRequest(s, r)
+	if w.Code != 200 {
+		t.Fatalf("%s: got %d %q", r.URL, w.Code, w.Body.String())
+	}
+	env := map[string]string{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if name, value, ok := strings.Cut(line, "="); ok {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+func TestCGIPathVariables(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "api.sh")
+	if err := os.WriteFile(script, []byte(envScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, `{
+		"handlers": {".sh": `+shHandler+`},
+		"path_handlers": {"/api/": {"command": "/bin/sh", "args": ["`+script+`"]}}
+	}`, map[string]string{"app.sh": envScript, "sub/env.sh": envScript})
+	home := s.Config().HomeDir
+	tests := []struct {
+		target                                               string
+		scriptName, scriptFilename, pathInfo, pathTranslated string
+	}{
+		{"/app.sh", "/app.sh", filepath.Join(home, "app.sh"), "", ""},
+		{"/app.sh/users/1?x=y", "/app.sh", filepath.Join(home, "app.sh"), "/users/1", filepath.Join(home, "users", "1")},
+		{"/sub/env.sh/a%20b", "/sub/env.sh", filepath.Join(home, "sub", "env.sh"), "/a b", filepath.Join(home, "a b")},
+		{"/api/v1/items", "/api", "", "/v1/items", filepath.Join(home, "v1", "items")},
+	}
+	for _, tt := range tests {
+		env := handlerEnv(t, s, httptest.NewRequest("GET", tt.target, nil))
+		if env["SCRIPT_NAME"] != tt.scriptName || env["PATH_INFO"] != tt.pathInfo || env["PATH_TRANSLATED"] != tt.pathTranslated {
+			t.Errorf("%s: SCRIPT_NAME=%q PATH_INFO=%q PATH_TRANSLATED=%q, want %q %q %q", tt.target,
+				env["SCRIPT_NAME"], env["PATH_INFO"], env["PATH_TRANSLATED"], tt.scriptName, tt.pathInfo, tt.pathTranslated)
+		}
+		if tt.scriptFilename != "" && env["SCRIPT_FILENAME"] != tt.scriptFilename {
+			t.Errorf("%s: SCRIPT_FILENAME=%q, want %q", tt.target, env["SCRIPT_FILENAME"], tt.scriptFilename)
+		}
+		if env["QUERY_STRING"] != httptest.NewRequest("GET", tt.target, nil).URL.RawQuery {
+			t.Errorf("%s: QUERY_STRING=%q", tt.target, env["QUERY_STRING"])
+		}
+	}
+}
+
+func TestCGIServerVariables(t *testing.T) {
+	for _, tt := range []struct{ config, software string }{
+		{`{"handlers": {".sh": ` + shHandler + `}}`, "webexec-lite/" + version},
+		{`{"server_software": "my-server/2", "handlers": {".sh": ` + shHandler + `}}`, "my-server/2"},
+	} {
+		s := testServer(t, tt.config, map[string]string{"env.sh": envScript})
+		r := httptest.NewRequest("GET", "/env.sh", nil)
+		r.RemoteAddr = "192.0.2.7:41234"
+		env := handlerEnv(t, s, r)
+		want := map[string]string{
+			"GATEWAY_INTERFACE": "CGI/1.1",
+			"SERVER_SOFTWARE":   tt.software,
+			"REMOTE_ADDR":       "192.0.2.7",
+			"REMOTE_HOST":       "192.0.2.7",
+			"REMOTE_PORT":       "41234",
+		}
+		for name, value := range want {
+			if env[name] != value {
+				t.Errorf("%s: %s=%q, want %q", tt.software, name, env[name], value)
+			}
+		}
+	}
+}
+
+func TestPHPCGIStubGetsScriptFilenameAndNoArgs(t *testing.T) {
+	// Stands in for php-cgi, which takes no args and finds the script
+	// through SCRIPT_FILENAME, refusing to run without REDIRECT_STATUS.
+	stub := filepath.Join(t.TempDir(), "php-cgi")
+	err := os.WriteFile(stub, []byte(`#!/bin/sh
+[ -n "$REDIRECT_STATUS" ] || { echo 'Status: 403'; echo; exit 0; }
+printf 'Content-Type: text/html\n\n'
+echo "args=$#"
+echo "script=$SCRIPT_FILENAME"
+cat "$SCRIPT_FILENAME"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, `{"default_indexes": ["index.php"], "handlers": {".php": {"command": "`+stub+`"}}}`,
+		map[string]string{"index.php": "<?php echo 1; ?>", "app/info.php": "<?php phpinfo(); ?>"})
+	home := s.Config().HomeDir
+	for target, file := range map[string]string{
+		"/":                        filepath.Join(home, "index.php"),
+		"/app/info.php":            filepath.Join(home, "app", "info.php"),
+		"/app/info.php/extra?q=-s": filepath.Join(home, "app", "info.php"),
+	} {
+		w := serve(s, "GET", target)
+		content, _ := os.ReadFile(file)
+		want := "args=0\nscript=" + file + "\n" + string(content)
+		if w.Code != 200 || w.Body.String() != want {
+			t.Errorf("%s: got %d %q, want 200 %q", target, w.Code, w.Body.String(), want)
+		}
+	}
+}
+
+func TestHandlerContentLength(t *testing.T) {
+	s := testServer(t, `{"handler_buffer_size": 100, "handlers": {".sh": `+shHandler+`}}`, map[string]string{
+		"small.sh":    "printf 'Content-Type: text/plain\\n\\nhello'",
+		"bare.sh":     "printf 'hello world'",
+		"declared.sh": "printf 'Content-Type: text/plain\\nContent-Length: 5\\n\\nhello'",
+		"empty.sh":    "printf 'Status: 204\\n\\n'",
+		"large.sh":    "printf 'Content-Type: text/plain\\n\\n'; i=0; while [ $i -lt 50 ]; do printf 'xxxxxxxxxx'; i=$((i+1)); done",
+	})
+	tests := map[string]string{
+		"/small.sh":    "5",
+		"/bare.sh":     "11",
+		"/declared.sh": "5",
+		"/empty.sh":    "",
+		// Past handler_buffer_size the output is streamed.
+		"/large.sh": "",
+	}
+	for target, want := range tests {
+		w := serve(s, "GET", target)
+		if got := w.Header().Get("Content-Length"); got != want {
+			t.Errorf("%s: Content-Length %q, want %q", target, got, want)
+		}
+		if want != "" && strconv.Itoa(w.Body.Len()) != want {
+			t.Errorf("%s: body of %d bytes, Content-Length %s", target, w.Body.Len(), want)
+		}
+	}
+	if n := serve(s, "GET", "/large.sh").Body.Len(); n != 500 {
+		t.Errorf("/large.sh: got %d bytes, want 500", n)
+	}
+}
+
+func TestHandlerSpawnFailures(t *testing.T) {
+	dir := t.TempDir()
+	notExec := filepath.Join(dir, "not-exec")
+	badInterp := filepath.Join(dir, "bad-interp")
+	failing := filepath.Join(dir, "failing")
+	for path, content := range map[string]string{notExec: "#!/bin/sh\n", badInterp: "#!/nonexistent/interpreter\n", failing: "#!/bin/sh\nexit 3\n"} {
+		mode := os.FileMode(0755)
+		if path == notExec {
+			mode = 0644
+		}
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := testServer(t, `{"handlers": {
+		".missing": {"command": "`+filepath.Join(dir, "missing")+`"},
+		".noexec": {"command": "`+notExec+`"},
+		".interp": {"command": "`+badInterp+`"},
+		".fail": {"command": "`+failing+`"}
+	}}`, map[string]string{"x.missing": "", "x.noexec": "", "x.interp": "", "x.fail": ""})
+	var logBuf bytes.Buffer
+	s.handlerLogger = log.New(&logBuf, "", 0)
+	tests := []struct {
+		target string
+		code   int
+		event  string
+	}{
+		{"/x.missing", 502, ""},
+		{"/x.noexec", 502, ""},
+		// Executable, but exec fails before the script runs.
+		{"/x.interp", 502, "spawn failed"},
+		// The script ran and failed: its own problem, not the deployment's.
+		{"/x.fail", 500, "exited with code 3"},
+	}
+	for _, tt := range tests {
+		logBuf.Reset()
+		if code := serve(s, "GET", tt.target).Code; code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.target, code, tt.code)
+		}
+		if !strings.Contains(logBuf.String(), tt.event) {
+			t.Errorf("%s: handler log %q lacks %q", tt.target, logBuf.String(), tt.event)
+		}
+	}
+}
+
+func TestLargeBodyEchoesThroughHandler(t *testing.T) {
+	s := testServer(t, `{"handler_buffer_size": 4096, "handlers": {".sh": `+shHandler+`}}`,
+		map[string]string{"echo.sh": "printf 'Content-Type: application/octet-stream\\n\\n'; cat"})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// Each chunk must come back before the next is sent, so neither the
+	// upload nor the response can be buffered in full.
+	const chunkSize, chunks = 64 << 10, 64
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", ts.URL+"/echo.sh", pr)
+	req.ContentLength = chunkSize * chunks
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		done <- result{resp, err}
+	}()
+	chunk := func(i int) []byte { return bytes.Repeat([]byte{byte('a' + i%26)}, chunkSize) }
+	if _, err := pw.Write(chunk(0)); err != nil {
+		t.Fatal(err)
+	}
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response after the first chunk")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	defer res.resp.Body.Close()
+	got := make([]byte, chunkSize)
+	for i := range chunks {
+		if i > 0 {
+			if _, err := pw.Write(chunk(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := io.ReadFull(res.resp.Body, got); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if !bytes.Equal(got, chunk(i)) {
+			t.Fatalf("chunk %d came back different", i)
+		}
+	}
+	pw.Close()
+	if rest, _ := io.ReadAll(res.resp.Body); len(rest) != 0 {
+		t.Errorf("%d extra bytes after the echo", len(rest))
+	}
+}
+
+func TestForwardedHTTPS(t *testing.T) {
+	s := testServer(t, `{"trusted_proxies": ["10.0.0.0/8"], "handlers": {".sh": `+shHandler+`}}`,
+		map[string]string{"env.sh": envScript})
+	tests := []struct {
+		remote, proto, scheme string
+	}{
+		{"10.1.2.3:5000", "https", "https"},
+		{"10.1.2.3:5000", "HTTPS, http", "https"},
+		{"10.1.2.3:5000", "http", "http"},
+		{"10.1.2.3:5000", "", "http"},
+		{"192.0.2.7:5000", "https", "http"}, // untrusted peer
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/env.sh", nil)
+		r.RemoteAddr = tt.remote
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		env := handlerEnv(t, s, r)
+		if env["REQUEST_SCHEME"] != tt.scheme || (env["HTTPS"] == "on") != (tt.scheme == "https") {
+			t.Errorf("%s with %q: REQUEST_SCHEME=%q HTTPS=%q, want %s",
+				tt.remote, tt.proto, env["REQUEST_SCHEME"], env["HTTPS"], tt.scheme)
+		}
+	}
+
+	// The plain-HTTP redirector passes forwarded HTTPS through.
+	cfg := *s.Config()
+	cfg.TLSPort = "443"
+	s.SetConfig(&cfg)
+	h := redirectToHTTPS(s)
+	for _, tt := range []struct {
+		remote string
+		code   int
+	}{
+		{"10.1.2.3:5000", 200},
+		{"192.0.2.7:5000", http.StatusMovedPermanently},
+	} {
+		r := httptest.NewRequest("GET", "/env.sh", nil)
+		r.RemoteAddr = tt.remote
+		r.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.code {
+			t.Errorf("redirector, %s: got %d, want %d", tt.remote, w.Code, tt.code)
+		}
+	}
+}
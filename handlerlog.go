@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// handlerRun collects what the handler log records about one handler
+// invocation. In the default text format each event is logged as it happens
+// and finish adds a summary line; with handler_log_format "json" finish
+// writes everything as a single JSON object instead.
+type handlerRun struct {
+	logger   *log.Logger
+	json     bool
+	r        *http.Request
+	command  string
+	args     []string
+	filePath string
+	route    string
+	start    time.Time
+	events   []string
+	ran      bool  // the process was started; exitErr is its outcome
+	exitErr  error // from Wait
+	stderr   string
+}
+
+func newHandlerRun(handlerLogger *log.Logger, cfg *Config, r *http.Request, command string, args []string, filePath, route string) *handlerRun {
+	return &handlerRun{
+		logger:   handlerLogger,
+		json:     cfg.HandlerLogFormat == "json",
+		r:        r,
+		command:  command,
+		args:     args,
+		filePath: filePath,
+		route:    route,
+		start:    time.Now(),
+	}
+}
+
+// event records something that happened during the run.
+func (h *handlerRun) event(event string) {
+	if h.logger == nil {
+		return
+	}
+	if h.json {
+		h.events = append(h.events, event)
+		return
+	}
+	r := h.r
+	h.logger.Printf("%s | %s | %s | %s %s | %s", logTime(time.Now(), time.RFC3339), h.command, event, r.Method, r.URL.RequestURI(), requestClientIP(r))
+}
+
+// exited records the outcome of a process that was started, and the first
+// line it wrote to stderr.
+func (h *handlerRun) exited(err error, stderr []byte) {
+	h.ran, h.exitErr, h.stderr = true, err, firstLine(stderr)
+}
+
+// finish logs the end of the run with the status sent to the client.
+func (h *handlerRun) finish(status int) {
+	if h.logger == nil {
+		return
+	}
+	r := h.r
+	if !h.json {
+		h.logger.Printf("%s | %s | %v | %s | %s %s | %s | status=%d route=%s", logTime(time.Now(), time.RFC3339), h.command, h.args, h.filePath, r.Method, r.URL.RequestURI(), requestClientIP(r), status, h.route)
+		return
+	}
+	entry := map[string]any{
+		"timestamp":   logTime(time.Now(), time.RFC3339),
+		"command":     h.command,
+		"args":        h.args,
+		"filepath":    h.filePath,
+		"route":       h.route,
+		"method":      r.Method,
+		"uri":         r.URL.RequestURI(),
+		"remote":      requestClientIP(r),
+		"request_id":  requestID(r),
+		"status":      status,
+		"duration_ms": durationMS(time.Since(h.start)),
+		"exit_code":   nil,
+		"signaled":    false,
+	}
+	if h.args == nil {
+		entry["args"] = []string{}
+	}
+	if h.ran {
+		entry["exit_code"] = 0
+		var exitErr *exec.ExitError
+		if errors.As(h.exitErr, &exitErr) {
+			entry["exit_code"] = exitErr.ExitCode()
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				entry["signaled"] = true
+			}
+		}
+	}
+	if h.stderr != "" {
+		entry["stderr_snippet"] = h.stderr
+	}
+	if len(h.events) > 0 {
+		entry["events"] = h.events
+	}
+	if data, err := json.Marshal(entry); err == nil {
+		// bypass the logger's timestamp prefix so each line is valid JSON
+		rawLogOutput(h.logger).Write(append(data, '\n'))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIndexHandlerRunIsLogged(t *testing.T) {
+	s := testServer(t, `{
+		"default_indexes": ["index.php", "index.html"],
+		"handler_log_format": "json",
+		"handlers": {".php": `+shHandler+`}
+	}`, map[string]string{
+		"dir/index.php":  "printf 'Content-Type: text/plain\\n\\nfrom php'",
+		"dir/index.html": "static",
+	})
+	var logBuf bytes.Buffer
+	s.handlerLogger = log.New(&logBuf, "", 0)
+	if w := serve(s, "GET", "/dir/"); w.Code != 200 || w.Body.String() != "from php" {
+		t.Fatalf("/dir/: got %d %q, want the index.php output", w.Code, w.Body.String())
+	}
+	var entry struct {
+		Filepath, Route, URI string
+		Status               int
+		ExitCode             *int `json:"exit_code"`
+	}
+	if err := json.Unmarshal(logBuf.Bytes(), &entry); err != nil {
+		t.Fatalf("handler log %q: %v", logBuf.String(), err)
+	}
+	want := filepath.Join(s.Config().HomeDir, "dir", "index.php")
+	if entry.Filepath != want || entry.Route != ".php" || entry.URI != "/dir/" || entry.Status != 200 || entry.ExitCode == nil || *entry.ExitCode != 0 {
+		t.Errorf("handler log entry %+v, want %s run for /dir/ with status 200 and exit code 0", entry, want)
+	}
+}
+
+func TestHandlerExitIsLogged(t *testing.T) {
+	files := map[string]string{
+		"fail.sh":   "echo 'first problem' >&2; echo 'second' >&2; exit 2",
+		"killed.sh": "kill -9 $$",
+	}
+	config := `{"handler_log_format": "%s", "error_pages": {}, "handlers": {".sh": ` + shHandler + `}}`
+
+	s := testServer(t, fmt.Sprintf(config, "json"), files)
+	var logBuf bytes.Buffer
+	s.handlerLogger = log.New(&logBuf, "", 0)
+	tests := []struct {
+		target   string
+		exitCode int
+		signaled bool
+		stderr   string
+	}{
+		{"/fail.sh", 2, false, "first problem"},
+		{"/killed.sh", -1, true, ""},
+	}
+	for _, tt := range tests {
+		logBuf.Reset()
+		if code := serve(s, "GET", tt.target).Code; code != 500 {
+			t.Errorf("%s: got %d, want 500", tt.target, code)
+		}
+		var entry struct {
+			Status        int
+			ExitCode      *int   `json:"exit_code"`
+			Signaled      bool   `json:"signaled"`
+			StderrSnippet string `json:"stderr_snippet"`
+		}
+		if err := json.Unmarshal(logBuf.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: handler log %q: %v", tt.target, logBuf.String(), err)
+		}
+		if entry.Status != 500 || entry.ExitCode == nil || *entry.ExitCode != tt.exitCode || entry.Signaled != tt.signaled || entry.StderrSnippet != tt.stderr {
+			t.Errorf("%s: logged %s, want exit code %d, signaled %v, stderr %q", tt.target, logBuf.String(), tt.exitCode, tt.signaled, tt.stderr)
+		}
+	}
+
+	// The text log names the exit reason as an event.
+	s = testServer(t, fmt.Sprintf(config, "text"), files)
+	logBuf.Reset()
+	s.handlerLogger = log.New(&logBuf, "", 0)
+	serve(s, "GET", "/fail.sh")
+	if !strings.Contains(logBuf.String(), "exited with code 2 | stderr: first problem") || !strings.Contains(logBuf.String(), "status=500") {
+		t.Errorf("text handler log %q lacks the exit code, stderr or status", logBuf.String())
+	}
+	logBuf.Reset()
+	serve(s, "GET", "/killed.sh")
+	if !strings.Contains(logBuf.String(), "killed by signal 9 (killed)") {
+		t.Errorf("text handler log %q lacks the signal", logBuf.String())
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// defaultHandlerBufferSize is how much handler output is held back before the
+// response is committed. Output that fits gets a Content-Length, byte ranges
+// and the error page on failure; longer output is streamed.
+const defaultHandlerBufferSize = 1 << 20
+
+// spillWriter is a handler's stdout. It buffers up to limit bytes; once the
+// output grows past that it sends the headers and streams the rest straight
+// to the client, flushing after every write, so memory stays bounded however
+// much the handler writes. With stream set it commits as soon as the CGI
+// header block is complete instead, or, for output that has none, as soon as
+// that is clear, with the default headers.
+type spillWriter struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	cfg    *Config
+	limit  int
+	stream bool
+	buf    bytes.Buffer
+	status int  // non-zero once the response has been committed
+	skip   bool // body not sent: HEAD or 304
+	err    error
+}
+
+// headerBlockComplete reports whether output contains the blank line that
+// ends a CGI header block.
+func headerBlockComplete(output []byte) bool {
+	return bytes.Contains(output, []byte("\n\n")) || bytes.Contains(output, []byte("\n\r\n"))
+}
+
+func (s *spillWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.buf.Write(p)
+		if s.buf.Len() > s.limit || (s.stream && (headerBlockComplete(s.buf.Bytes()) || !mayBeCGIHeader(s.buf.Bytes()))) {
+			s.commit()
+		}
+		return len(p), s.err
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if !s.skip {
+		if _, err := s.w.Write(p); err != nil {
+			s.err = err
+			return 0, err
+		}
+		http.NewResponseController(s.w).Flush()
+	}
+	return len(p), nil
+}
+
+// commit writes the response header from the buffered output and sends the
+// body collected so far.
+func (s *spillWriter) commit() {
+	// The handler may still be reading the request body.
+	http.NewResponseController(s.w).EnableFullDuplex()
+	status, body := applyHandlerHeaders(s.w, s.buf.Bytes())
+	h := s.w.Header()
+	if status == 200 && handlerNotModified(s.r, h) {
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		status, s.skip = http.StatusNotModified, true
+	}
+	if h.Get("Content-Type") == "" && !s.skip {
+		h.Set("Content-Type", s.cfg.DefaultContentType)
+	}
+	s.status = status
+	s.skip = s.skip || s.r.Method == http.MethodHead
+	s.w.WriteHeader(status)
+	if !s.skip {
+		if _, err := s.w.Write(body); err != nil {
+			s.err = err
+			return
+		}
+		http.NewResponseController(s.w).Flush()
+	}
+	s.buf = bytes.Buffer{}
+}
+
+// streamed reports whether the response was already sent while the handler
+// ran.
+func (s *spillWriter) streamed() bool {
+	return s.status != 0
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// shuttingDown is set once a shutdown signal arrives so readiness checks fail
+// while in-flight requests drain.
+var shuttingDown atomic.Bool
+
+// serveHealth answers the health and readiness endpoints. It reports false
+// when urlPath is neither.
+func serveHealth(w http.ResponseWriter, cfg *Config, urlPath string) bool {
+	switch {
+	case cfg.HealthPath != "" && urlPath == cfg.HealthPath:
+	case cfg.ReadyPath != "" && urlPath == cfg.ReadyPath:
+		if shuttingDown.Load() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"status":"shutting down"}`))
+			return true
+		}
+	default:
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(`{"status":"ok"}`))
+	return true
+}
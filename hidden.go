@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// isHiddenName reports whether a single file or directory name is hidden from
+// listings and direct requests. Dotfiles are hidden unless ShowHidden is set,
+// except .well-known which hosts ACME challenges and similar public files.
+func isHiddenName(cfg *Config, name string) bool {
+	if !cfg.ShowHidden && strings.HasPrefix(name, ".") && name != ".well-known" {
+		return true
+	}
+	for _, pattern := range cfg.HiddenPatterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHiddenComponent reports whether any segment of urlPath is hidden.
+func hasHiddenComponent(cfg *Config, urlPath string) bool {
+	for _, seg := range strings.Split(urlPath, "/") {
+		if seg != "" && isHiddenName(cfg, seg) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ignoreFileName is the per-directory file of glob patterns naming files that
+// are never served or listed from that directory down.
+const (
+	ignoreFileName        = ".webexecignore"
+	maxIgnoreCacheEntries = 4096
+)
+
+type ignoreKey struct {
+	site FileSystem
+	path string
+}
+
+type ignoreEntry struct {
+	modTime  time.Time
+	patterns []string
+}
+
+var (
+	ignoreCacheMu sync.Mutex
+	ignoreCache   = make(map[ignoreKey]ignoreEntry)
+)
+
+// ignoreRule is the parsed ignore file of one directory.
+type ignoreRule struct {
+	dir      string
+	patterns []string
+}
+
+// ignoreRules holds the ignore files that apply inside a directory: its own
+// and those of every ancestor up to the site root.
+type ignoreRules []ignoreRule
+
+// ignoreRulesFor collects the ignore files that apply to entries of the site
+// directory dir.
+func ignoreRulesFor(site FileSystem, dir string) ignoreRules {
+	var rules ignoreRules
+	dir = path.Clean("/" + dir)
+	for {
+		if patterns := readIgnoreFile(site, path.Join(dir, ignoreFileName)); len(patterns) > 0 {
+			rules = append(rules, ignoreRule{dir: dir, patterns: patterns})
+		}
+		if dir == "/" {
+			return rules
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// ignores reports whether the site path name is matched by any of the rules.
+// A pattern without a slash matches any path component below the ignore
+// file's directory; one with a slash is matched against the path relative to
+// that directory, and also hides everything under a matching directory.
+func (rules ignoreRules) ignores(name string) bool {
+	name = path.Clean("/" + name)
+	if path.Base(name) == ignoreFileName {
+		return true
+	}
+	for _, rule := range rules {
+		rel, ok := strings.CutPrefix(name, strings.TrimSuffix(rule.dir, "/")+"/")
+		if !ok || rel == "" {
+			continue
+		}
+		segs := strings.Split(rel, "/")
+		for _, pattern := range rule.patterns {
+			if strings.Contains(pattern, "/") {
+				pattern = strings.Trim(pattern, "/")
+				for i := range segs {
+					if ok, _ := path.Match(pattern, strings.Join(segs[:i+1], "/")); ok {
+						return true
+					}
+				}
+				continue
+			}
+			for _, seg := range segs {
+				if ok, _ := path.Match(pattern, seg); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isIgnored reports whether the site path name is hidden by an ignore file in
+// its directory or any ancestor.
+func isIgnored(site FileSystem, name string) bool {
+	name = path.Clean("/" + name)
+	return ignoreRulesFor(site, path.Dir(name)).ignores(name)
+}
+
+// readIgnoreFile returns the patterns in the ignore file at name, or nil when
+// there is none. Parsed files are cached until their modification time
+// changes. Blank lines and lines starting with # are skipped.
+func readIgnoreFile(site FileSystem, name string) []string {
+	info, err := site.Stat(name)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	key := ignoreKey{site: site, path: name}
+	ignoreCacheMu.Lock()
+	entry, ok := ignoreCache[key]
+	ignoreCacheMu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) {
+		return entry.patterns
+	}
+
+	f, err := site.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	ignoreCacheMu.Lock()
+	if len(ignoreCache) >= maxIgnoreCacheEntries {
+		ignoreCache = make(map[ignoreKey]ignoreEntry)
+	}
+	ignoreCache[key] = ignoreEntry{modTime: info.ModTime(), patterns: patterns}
+	ignoreCacheMu.Unlock()
+	return patterns
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type IPRule struct {
+	Allow []string `json:"allow"` // CIDRs or IPs; when set, only these may connect
+	Deny  []string `json:"deny"`  // CIDRs or IPs that are always refused
+}
+
+// permits reports whether ip passes the rule: deny entries are checked first,
+// then a non-empty allow list must contain ip.
+func (rule IPRule) permits(ip string) bool {
+	if ipInPrefixes(ip, rule.Deny) {
+		return false
+	}
+	return len(rule.Allow) == 0 || ipInPrefixes(ip, rule.Allow)
+}
+
+// ipAllowed checks ip against the global allow/deny lists and then the
+// longest matching per-path rule.
+func ipAllowed(cfg *Config, ip, urlPath string) bool {
+	if !(IPRule{Allow: cfg.AllowIPs, Deny: cfg.DenyIPs}).permits(ip) {
+		return false
+	}
+	if _, rule, ok := longestPrefix(cfg.IPRules, urlPath); ok {
+		return rule.permits(ip)
+	}
+	return true
+}
+
+type clientIPKey struct{}
+
+// withClientIP records the client address worked out by clientIP on r.
+func withClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// requestClientIP returns the address stored by withClientIP, or the peer
+// address when there is none.
+func requestClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r.RemoteAddr)
+}
+
+// clientIP returns the address of the client that sent r. When the peer is in
+// trusted, the rightmost X-Forwarded-For entry that isn't itself a trusted
+// proxy is used, then X-Real-IP; otherwise the peer address.
+func clientIP(r *http.Request, trusted []string) string {
+	peer := remoteIP(r.RemoteAddr)
+	if len(trusted) == 0 || !ipInPrefixes(peer, trusted) {
+		return peer
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if !ipInPrefixes(hop, trusted) {
+				return hop
+			}
+		}
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); real != "" {
+		return real
+	}
+	return peer
+}
+
+// requestScheme returns "https" when r arrived over TLS, or when a trusted
+// proxy says in the forwarded_proto_header that its client connection did,
+// and "http" otherwise.
+func requestScheme(r *http.Request, cfg *Config) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if cfg.ForwardedProtoHeader != "" && len(cfg.TrustedProxies) > 0 && ipInPrefixes(remoteIP(r.RemoteAddr), cfg.TrustedProxies) {
+		proto, _, _ := strings.Cut(r.Header.Get(cfg.ForwardedProtoHeader), ",")
+		if strings.EqualFold(strings.TrimSpace(proto), "https") {
+			return "https"
+		}
+	}
+	return "http"
+}
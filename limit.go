@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// semaphore is a counting semaphore; its capacity is the concurrency limit.
+type semaphore chan struct{}
+
+var (
+	semaphoresMu sync.Mutex
+	semaphores   = make(map[string]semaphore)
+)
+
+// getSemaphore returns the semaphore registered under key, replacing it when
+// the configured size changed (e.g. after a reload). Holders of a replaced
+// semaphore release into the old one, which is then dropped.
+func getSemaphore(key string, size int) semaphore {
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+	s, ok := semaphores[key]
+	if !ok || cap(s) != size {
+		s = make(semaphore, size)
+		semaphores[key] = s
+	}
+	return s
+}
+
+// acquire takes a slot, waiting up to timeout (forever when timeout is 0) or
+// until ctx is done. It returns how long it waited and whether it succeeded.
+func (s semaphore) acquire(ctx context.Context, timeout time.Duration) (time.Duration, bool) {
+	select {
+	case s <- struct{}{}:
+		return 0, true
+	default:
+	}
+	start := time.Now()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case s <- struct{}{}:
+		return time.Since(start), true
+	case <-expired:
+	case <-ctx.Done():
+	}
+	return time.Since(start), false
+}
+
+// tryAcquire takes a slot if one is free, without waiting.
+func (s semaphore) tryAcquire() bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"encoding/json"
+	"io"
 	"log"
+	"log/syslog"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type StatusWriter struct {
 	http.ResponseWriter
 	Status int
-	Bytes  int
+	Bytes  int64     // body bytes written, after compression: what was actually sent
+	Start  time.Time // when the request began; used for durations in the access log
 }
 
 func (w *StatusWriter) WriteHeader(code int) {
@@ -22,46 +30,331 @@ func (w *StatusWriter) WriteHeader(code int) {
 
 func (w *StatusWriter) Write(b []byte) (int, error) {
 	n, err := w.ResponseWriter.Write(b)
-	w.Bytes += n
+	w.Bytes += int64(n)
 	return n, err
 }
 
-func OpenLogFile(path string) *os.File {
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed proxy responses.
+func (w *StatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ReadFrom keeps the underlying writer's io.ReaderFrom fast path available
+// while still counting the bytes sent. http.ServeContent copies files through
+// it, so static files, ranges included, go out with sendfile.
+func (w *StatusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(src)
+		w.Bytes += n
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{w}, src)
+}
+
+// RotatingFile is an append-only log file that, when maxSize is set, renames
+// itself to path.1 (shifting older files up to path.<maxFiles>) once a write
+// would push it past maxSize. It is safe for concurrent use.
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func OpenLogFile(path string, maxSize int64, maxFiles int) *RotatingFile {
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Printf("Failed to open log file %s: %v", path, err)
 		return nil
 	}
-	return f
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+	return &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles, file: f, size: size}
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	if f == nil {
+		return 0, os.ErrInvalid
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			log.Printf("Failed to rotate log file %s: %v", f.path, err)
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+	}
+	renameErr := os.Rename(f.path, f.path+".1")
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = 0
+	if info, err := file.Stat(); err == nil {
+		f.size = info.Size()
+	}
+	return renameErr
+}
+
+func (f *RotatingFile) Close() error {
+	if f == nil {
+		return os.ErrInvalid
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// OpenLogTarget opens the destination of one log: a file path, "stdout" or
+// "stderr", "syslog:" for the local syslog daemon, or "syslog://host:port"
+// ("syslog+tcp://host:port" for TCP) for a remote one. When syslog can't be
+// reached the log goes to stderr instead. It returns nil if a log file cannot
+// be opened.
+func OpenLogTarget(target string, maxSize int64, maxFiles int, priority syslog.Priority) io.WriteCloser {
+	switch target {
+	case "stdout":
+		return stdStream{os.Stdout}
+	case "stderr":
+		return stdStream{os.Stderr}
+	}
+	if !strings.HasPrefix(target, "syslog:") && !strings.HasPrefix(target, "syslog+tcp:") {
+		if f := OpenLogFile(target, maxSize, maxFiles); f != nil {
+			return f
+		}
+		return nil
+	}
+	w, err := dialSyslog(target, priority)
+	if err != nil {
+		log.Printf("Failed to connect to syslog %s: %v; logging to stderr", target, err)
+		return stdStream{os.Stderr}
+	}
+	return w
 }
 
-func LogAccess(r *http.Request, ww *StatusWriter, accessLogger *log.Logger) {
-	remoteHost := r.RemoteAddr
-	if idx := strings.LastIndex(remoteHost, ":"); idx != -1 {
-		remoteHost = remoteHost[:idx]
+func dialSyslog(target string, priority syslog.Priority) (*syslog.Writer, error) {
+	const tag = "webexec-lite"
+	if target == "syslog:" || target == "syslog://" {
+		return syslog.New(priority, tag)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp"
+	if u.Scheme == "syslog+tcp" {
+		network = "tcp"
+	}
+	return syslog.Dial(network, u.Host, priority, tag)
+}
+
+// stdStream is a log written to stdout or stderr, which must stay open when
+// the log is closed.
+type stdStream struct {
+	*os.File
+}
+
+func (stdStream) Close() error { return nil }
+
+// logOutput returns w as a logger's output, discarding entries for a log
+// that could not be opened.
+func logOutput(w io.WriteCloser) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
+
+// newLogger returns a logger writing to w, or discarding when w is nil.
+func newLogger(w io.WriteCloser) *log.Logger {
+	return log.New(stampedLog{logOutput(w)}, "", 0)
+}
+
+// stampedLog prefixes each line a logger writes with the time, formatted by
+// logTime, in place of the log package's fixed local-time prefix.
+type stampedLog struct {
+	w io.Writer
+}
+
+func (s stampedLog) Write(b []byte) (int, error) {
+	line := make([]byte, 0, 32+len(b))
+	line = append(line, logTime(time.Now(), "2006/01/02 15:04:05")...)
+	line = append(line, ' ')
+	line = append(line, b...)
+	if _, err := s.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// rawLogOutput is logger's output without the time prefix, for entries such
+// as JSON objects that carry their own timestamp.
+func rawLogOutput(logger *log.Logger) io.Writer {
+	if s, ok := logger.Writer().(stampedLog); ok {
+		return s.w
+	}
+	return logger.Writer()
+}
+
+// logClock is how log timestamps are written: log_time_format and
+// log_time_utc.
+type logClock struct {
+	layout string // empty keeps each log's own layout
+	utc    bool
+}
+
+var logTimes atomic.Pointer[logClock]
+
+// logTimeLayouts are the names log_time_format accepts besides a Go layout.
+var logTimeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"iso8601":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"common":      "02/Jan/2006:15:04:05 -0700",
+}
+
+// setLogTimes makes cfg's log_time_format and log_time_utc apply to every
+// log from now on. It is called at startup and on reload.
+func setLogTimes(cfg *Config) {
+	layout := cfg.LogTimeFormat
+	if named, ok := logTimeLayouts[strings.ToLower(layout)]; ok {
+		layout = named
+	}
+	logTimes.Store(&logClock{layout: layout, utc: cfg.LogTimeUTC})
+}
+
+// logTime formats t for a log entry, with layout unless log_time_format
+// overrides it.
+func logTime(t time.Time, layout string) string {
+	if c := logTimes.Load(); c != nil {
+		if c.utc {
+			t = t.UTC()
+		}
+		if c.layout != "" {
+			layout = c.layout
+		}
+	}
+	return t.Format(layout)
+}
+
+// ReopenLog switches logger to a freshly opened target and closes the
+// previous one, so externally rotated log files are picked up. If the new
+// target cannot be opened the logger keeps writing to old.
+func ReopenLog(logger *log.Logger, old io.WriteCloser, target string, maxSize int64, maxFiles int, priority syslog.Priority) io.WriteCloser {
+	w := OpenLogTarget(target, maxSize, maxFiles, priority)
+	if w == nil {
+		return old
+	}
+	logger.SetOutput(stampedLog{w})
+	if old != nil {
+		old.Close()
+	}
+	return w
+}
+
+// accessLogged reports whether a request for urlPath belongs in the access
+// log. Health checks are skipped unless log_health_checks is set, as is any
+// path matching a log_exclude pattern (path.Match syntax).
+func accessLogged(cfg *Config, urlPath string) bool {
+	if (urlPath == cfg.HealthPath || urlPath == cfg.ReadyPath) && !cfg.LogHealthChecks {
+		return false
+	}
+	for _, pattern := range cfg.LogExclude {
+		if ok, _ := path.Match(pattern, urlPath); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// LogRequestError writes one error log line for r: method, path, status,
+// client address and request ID, followed by detail when it is not empty.
+func LogRequestError(errorLogger *log.Logger, r *http.Request, status int, detail string) {
+	if errorLogger == nil {
+		return
+	}
+	line := r.Method + " " + r.URL.Path + " " + itoa(status) + " " + requestClientIP(r) + " id=" + requestID(r)
+	if detail != "" {
+		line += " " + detail
+	}
+	errorLogger.Println(line)
+}
+
+// LogAccess writes one access log entry for r in the given format: "common",
+// "combined" (the default) or "json".
+func LogAccess(r *http.Request, ww *StatusWriter, accessLogger *log.Logger, format string) {
+	if accessLogger == nil {
+		return
+	}
+	remoteHost := requestClientIP(r)
+	var duration time.Duration
+	if !ww.Start.IsZero() {
+		duration = time.Since(ww.Start)
+	}
+	if format == "json" {
+		entry := map[string]any{
+			"time":        logTime(time.Now(), time.RFC3339),
+			"remote_host": remoteHost,
+			"method":      r.Method,
+			"path":        r.URL.RequestURI(),
+			"proto":       r.Proto,
+			"status":      ww.Status,
+			"bytes":       ww.Bytes,
+			"referer":     r.Referer(),
+			"user_agent":  r.UserAgent(),
+			"duration_ms": durationMS(duration),
+			"request_id":  requestID(r),
+		}
+		if data, err := json.Marshal(entry); err == nil {
+			// bypass the logger's timestamp prefix so each line is valid JSON
+			rawLogOutput(accessLogger).Write(append(data, '\n'))
+		}
+		return
 	}
 	user := "-"
 	identd := "-"
-	timeStr := time.Now().Format("02/Jan/2006:15:04:05 -0700")
+	timeStr := logTime(time.Now(), "02/Jan/2006:15:04:05 -0700")
 	requestLine := r.Method + " " + r.URL.RequestURI() + " " + r.Proto
-	status := ww.Status
-	bytes := ww.Bytes
-	referer := r.Referer()
-	if referer == "" {
-		referer = "-"
-	}
-	userAgent := r.UserAgent()
-	if userAgent == "" {
-		userAgent = "-"
-	}
-	logMsg :=
-		remoteHost + " " + identd + " " + user + " [" + timeStr + "] \"" + requestLine + "\" " +
-			itoa(status) + " " + itoa(bytes) + " \"" + referer + "\" \"" + userAgent + "\""
-	if accessLogger != nil {
-		accessLogger.Println(logMsg)
+	logMsg := remoteHost + " " + identd + " " + user + " [" + timeStr + "] \"" + requestLine + "\" " +
+		itoa(ww.Status) + " " + strconv.FormatInt(ww.Bytes, 10)
+	if format != "common" {
+		referer := r.Referer()
+		if referer == "" {
+			referer = "-"
+		}
+		userAgent := r.UserAgent()
+		if userAgent == "" {
+			userAgent = "-"
+		}
+		logMsg += " \"" + referer + "\" \"" + userAgent + "\" " + strconv.FormatFloat(durationMS(duration), 'f', 3, 64) + " " + requestID(r)
 	}
+	accessLogger.Println(logMsg)
+}
+
+// durationMS converts d to fractional milliseconds.
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
 }
 
 func itoa(i int) string {
 	return strconv.Itoa(i)
-} 
\ No newline at end of file
+}
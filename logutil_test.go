@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogsUseForwardedClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.RemoteAddr = "127.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r = withClientIP(r, clientIP(r, []string{"127.0.0.1"}))
+
+	var errBuf, handlerBuf bytes.Buffer
+	LogRequestError(log.New(&errBuf, "", 0), r, 404, "")
+	run := newHandlerRun(log.New(&handlerBuf, "", 0), &Config{}, r, "/bin/true", nil, "/x", ".sh")
+	run.event("queued")
+	run.finish(200)
+	for name, out := range map[string]string{"error log": errBuf.String(), "handler log": handlerBuf.String()} {
+		if !strings.Contains(out, "203.0.113.9") || strings.Contains(out, "127.0.0.1") {
+			t.Errorf("%s should show the forwarded client, got %q", name, out)
+		}
+	}
+}
+
+func TestAccessLogCountsStaticFileBytes(t *testing.T) {
+	big := strings.Repeat("0123456789", 20000)
+	s := testServer(t, `{"log_format": "json"}`, map[string]string{"big.bin": big, "small.txt": "hello"})
+	var logBuf bytes.Buffer
+	s.accessLogger = log.New(&logBuf, "", 0)
+	// Through a real connection, so the file goes out via ReadFrom.
+	ts := httptest.NewServer(s)
+	tests := []struct {
+		target, rangeHeader string
+		want                int64
+	}{
+		{"/big.bin", "", int64(len(big))},
+		{"/small.txt", "", 5},
+		{"/big.bin", "bytes=100-1099", 1000},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", ts.URL+tt.target, nil)
+		if tt.rangeHeader != "" {
+			r.Header.Set("Range", tt.rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if n != tt.want {
+			t.Fatalf("%s: received %d bytes, want %d", tt.target, n, tt.want)
+		}
+	}
+	ts.Close() // waits for the requests, and so their log lines
+
+	lines := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("got %d access log lines, want %d: %q", len(lines), len(tests), logBuf.String())
+	}
+	for i, tt := range tests {
+		var entry struct{ Bytes int64 }
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Bytes != tt.want {
+			t.Errorf("%s %s: logged %d bytes, want %d", tt.target, tt.rangeHeader, entry.Bytes, tt.want)
+		}
+	}
+}
@@ -1,77 +1,705 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/syslog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
+// Build metadata, reported by -version, in SERVER_SOFTWARE and in the Server
+// header. Release builds set them with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 type ErrorPages struct {
-	NotFound string `json:"404"`
-	Internal string `json:"500"`
+	NotFound           string `json:"404"`
+	Internal           string `json:"500"`
+	Forbidden          string `json:"403"`
+	ServiceUnavailable string `json:"503"`
+}
+
+type CompressionConfig struct {
+	Enabled bool     `json:"enabled"`
+	Types   []string `json:"types"`    // MIME types or file extensions (".css") to compress
+	MinSize int64    `json:"min_size"` // bytes; responses with a smaller Content-Length are sent as-is
+}
+
+type AuthConfig struct {
+	Realm string            `json:"realm"`
+	Users map[string]string `json:"users"` // username -> bcrypt hash
 }
 
 type HandlerConfig struct {
-	Command string   `json:"command"`
-	Args    []string `json:"args"`
+	Command       string   `json:"command"`
+	Args          []string `json:"args"`
+	Timeout       int      `json:"timeout"`        // seconds; 0 uses Config.HandlerTimeout
+	Methods       []string `json:"methods"`        // allowed HTTP methods; empty allows all
+	MaxConcurrent int      `json:"max_concurrent"` // 0 means no per-handler limit
+	Type          string   `json:"type"`           // "exec" (default) or "fastcgi"
+	Address       string   `json:"address"`        // fastcgi: "host:port" or "unix:/path/to/socket"
+	Stream        bool     `json:"stream"`         // send output as it is written instead of buffering it
+	AccessLog     string   `json:"access_log"`     // separate access log for this handler's requests, or "off"
+	ContentTypes  []string `json:"content_types"`  // request media types the handler takes; empty takes any
 }
 
 type Config struct {
-	HomeDir        string                  `json:"homedir"`
-	Port           string                  `json:"port"`
-	ErrorPages     ErrorPages              `json:"error_pages"`
-	DefaultIndexes []string                `json:"default_indexes"`
-	Handlers       map[string]HandlerConfig `json:"handlers"`
-	AccessLog      string                  `json:"access_log"`
-	ErrorLog       string                  `json:"error_log"`
-	HandlerLog     string                  `json:"handler_log"`
+	HomeDir                 string                       `json:"homedir"`
+	Port                    string                       `json:"port"`
+	ErrorPages              ErrorPages                   `json:"error_pages"`
+	DefaultIndexes          []string                     `json:"default_indexes"`
+	Handlers                map[string]HandlerConfig     `json:"handlers"`
+	PathHandlers            map[string]HandlerConfig     `json:"path_handlers"` // URL prefix -> handler, checked before Handlers
+	AccessLog               string                       `json:"access_log"`
+	ErrorLog                string                       `json:"error_log"`
+	HandlerLog              string                       `json:"handler_log"`
+	TLSCert                 string                       `json:"tls_cert"`
+	TLSKey                  string                       `json:"tls_key"`
+	TLSPort                 string                       `json:"tls_port"`
+	RedirectHTTP            bool                         `json:"redirect_http"`
+	HandlerTimeout          int                          `json:"handler_timeout"` // seconds; 0 means no limit
+	Compression             CompressionConfig            `json:"compression"`
+	Auth                    map[string]AuthConfig        `json:"auth"`          // URL path prefix -> credentials
+	MaxLogSize              int64                        `json:"max_log_size"`  // bytes; 0 disables rotation
+	MaxLogFiles             int                          `json:"max_log_files"` // rotated files to keep
+	ETag                    bool                         `json:"etag"`
+	ETagHashLimit           int64                        `json:"etag_hash_limit"`         // bytes; larger files get a size+modtime ETag
+	DirsFirst               bool                         `json:"dirs_first"`              // list directories before files
+	ShowHidden              bool                         `json:"show_hidden"`             // serve and list dotfiles
+	HiddenPatterns          []string                     `json:"hidden_patterns"`         // glob patterns of names to hide
+	ShutdownTimeout         int                          `json:"shutdown_timeout"`        // seconds to drain requests and handlers
+	VirtualHosts            map[string]VirtualHost       `json:"virtual_hosts"`           // hostname or "*.domain" -> overrides
+	Headers                 map[string]map[string]string `json:"headers"`                 // URL prefix or "*" -> response headers
+	EnvWhitelist            []string                     `json:"env_whitelist"`           // host variables passed to handlers; empty passes all
+	EnvExtra                map[string]string            `json:"env_extra"`               // extra variables set for every handler run
+	MaxConcurrentHandlers   int                          `json:"max_concurrent_handlers"` // 0 means unlimited
+	QueueTimeout            int                          `json:"queue_timeout"`           // seconds to wait for a handler slot; 0 waits indefinitely
+	LogFormat               string                       `json:"log_format"`              // access log format: common, combined (default) or json
+	Listen                  []string                     `json:"listen"`                  // host:port addresses; overrides Port when set
+	MimeTypes               map[string]string            `json:"mime_types"`              // file extension -> Content-Type for static files
+	CORS                    CORSConfig                   `json:"cors"`
+	RateLimit               RateLimitConfig              `json:"rate_limit"`
+	PrecompressedExtensions []string                     `json:"precompressed_extensions"`
+	Proxies                 map[string]ProxyConfig       `json:"proxies"`
+	HealthPath              string                       `json:"health_path"`
+	ReadyPath               string                       `json:"ready_path"`
+	LogHealthChecks         bool                         `json:"log_health_checks"`
+	Metrics                 MetricsConfig                `json:"metrics"`
+	DefaultContentType      string                       `json:"default_content_type"` // for handler output without a Content-Type
+	Nosniff                 bool                         `json:"nosniff"`
+	ServerSoftware          string                       `json:"server_software"`
+	ReadTimeout             int                          `json:"read_timeout"` // seconds; 0 uses the default, negative disables
+	ReadHeaderTimeout       int                          `json:"read_header_timeout"`
+	WriteTimeout            int                          `json:"write_timeout"`
+	IdleTimeout             int                          `json:"idle_timeout"`
+	Favicon                 string                       `json:"favicon"`    // served for /favicon.ico
+	RobotsTxt               string                       `json:"robots_txt"` // served for /robots.txt
+	AutoIndex               *bool                        `json:"auto_index"` // nil means true
+	AutoIndexPaths          map[string]bool              `json:"auto_index_paths"`
+	AllowIPs                []string                     `json:"allow_ips"`
+	DenyIPs                 []string                     `json:"deny_ips"`
+	IPRules                 map[string]IPRule            `json:"ip_rules"`             // per URL prefix
+	TrustedProxies          []string                     `json:"trusted_proxies"`      // peers whose X-Forwarded-For is believed
+	DebugHandlerErrors      bool                         `json:"debug_handler_errors"` // send handler output with 500s instead of the error page
+	LogExclude              []string                     `json:"log_exclude"`          // URL patterns kept out of the access log
+	ServerHeader            *string                      `json:"server_header"`        // nil sends webexec-lite/<version>, "" sends none
+	FollowSymlinks          bool                         `json:"follow_symlinks"`      // serve symlinks that point outside HomeDir
+	DirListTemplate         string                       `json:"dirlist_template"`
+	DevMode                 bool                         `json:"dev_mode"`               // re-read listing templates when they change
+	IndexPaths              map[string][]string          `json:"index_paths"`            // URL prefix -> index file names, overriding default_indexes
+	HandlerStrictPerms      bool                         `json:"handler_strict_perms"`   // refuse group/world-writable or foreign-owned handler commands
+	Mounts                  map[string]Mount             `json:"mounts"`                 // URL prefix -> document root
+	CacheControl            map[string]string            `json:"cache_control"`          // ".ext" or file name glob -> Cache-Control for static files
+	AllowedMethods          []string                     `json:"allowed_methods"`        // methods accepted on every route; handler methods override
+	HandlerBufferSize       int                          `json:"handler_buffer_size"`    // bytes of handler output buffered before streaming; 0 uses 1 MiB
+	TCPKeepAlive            int                          `json:"tcp_keepalive"`          // seconds between keep-alive probes; 0 uses the Go default, negative disables
+	MaxHeaderBytes          int                          `json:"max_header_bytes"`       // limit on request line plus headers; 0 uses Go's 1 MiB
+	ListingShowSize         *bool                        `json:"listing_show_size"`      // nil means true
+	ListingShowModTime      *bool                        `json:"listing_show_mod_time"`  // nil means true
+	StrictEnv               bool                         `json:"strict_env"`             // fail to load when a referenced environment variable is unset
+	ListingTitle            string                       `json:"listing_title"`          // listing page title; "{path}" is the directory, default "Index of {path}"
+	ListingHeaderHTML       string                       `json:"listing_header_html"`    // trusted HTML shown above listings
+	ListingFooterHTML       string                       `json:"listing_footer_html"`    // trusted HTML shown below listings
+	ForwardedProtoHeader    string                       `json:"forwarded_proto_header"` // scheme header believed from trusted_proxies
+	EnableH2C               bool                         `json:"enable_h2c"`             // accept HTTP/2 without TLS (prior knowledge) on the plain listeners
+	ErrorPagesMap           map[string]string            `json:"error_pages_map"`        // status code -> page, for any status; overrides error_pages
+	HandlerLogFormat        string                       `json:"handler_log_format"`     // "text" (default) or "json"
+	SPAFallback             map[string]string            `json:"spa_fallback"`           // URL prefix -> file served for unknown extensionless paths that accept HTML
+	MaxConnections          int                          `json:"max_connections"`        // requests served at once before answering 503; 0 means no limit
+	ListingPageSize         int                          `json:"listing_page_size"`      // entries per listing page; 0 uses 1000, negative puts every entry on one page
+	RequestTimeout          int                          `json:"request_timeout"`        // seconds for a whole request; 0 means no limit
+	LogTimeFormat           string                       `json:"log_time_format"`        // layout of log timestamps: "rfc3339", "common" or a Go layout; empty keeps each log's own
+	LogTimeUTC              bool                         `json:"log_time_utc"`           // log timestamps in UTC instead of local time
+
+	mount string // URL prefix of the mount this copy was made for; see mountConfig
 }
 
+// loadConfig reads the config at path, which is either a JSON file or a
+// directory whose *.json files are merged in name order (00-base.json,
+// 10-handlers.json, ...). Objects such as handlers and mounts are merged key
+// by key, recursively; any other value in a later file replaces the earlier
+// one. Environment variables in string values are expanded; see expandEnv.
 func loadConfig(path string) (*Config, error) {
-	file, err := os.Open(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return nil, err
+		}
+	}
+	merged := map[string]any{}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		mergeJSON(merged, m)
+	}
+	missing := map[string]bool{}
+	expandEnv(merged, false, missing)
+	if strict, _ := merged["strict_env"].(bool); strict && len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(names, ", "))
+	}
+	data, err := json.Marshal(merged)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 	var cfg Config
-	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
 	return &cfg, nil
 }
 
-func serveErrorPage(w http.ResponseWriter, code int, pagePath string, defaultMsg string) {
+var envBraces = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+// expandEnv replaces ${VAR} and $VAR in every string of a decoded config with
+// the variable's value, and "$$" with "$". Auth user hashes only take the
+// ${VAR} form, since bcrypt hashes are full of "$". Variables that are not
+// set expand to "" and are recorded in missing.
+func expandEnv(v any, bracesOnly bool, missing map[string]bool) any {
+	switch v := v.(type) {
+	case string:
+		lookup := func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			if !envBraces.MatchString("${" + name + "}") {
+				return "$" + name // e.g. "$1": not a variable, leave it
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing[name] = true
+			}
+			return value
+		}
+		if bracesOnly {
+			return envBraces.ReplaceAllStringFunc(v, func(m string) string { return lookup(m[2 : len(m)-1]) })
+		}
+		return os.Expand(v, lookup)
+	case []any:
+		for i := range v {
+			v[i] = expandEnv(v[i], bracesOnly, missing)
+		}
+	case map[string]any:
+		for k, e := range v {
+			v[k] = expandEnv(e, bracesOnly || k == "users", missing)
+		}
+	}
+	return v
+}
+
+// mergeJSON merges src into dst: nested objects recursively, everything else
+// by replacement.
+func mergeJSON(dst, src map[string]any) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]any); ok {
+			if dm, ok := dst[k].(map[string]any); ok {
+				mergeJSON(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		HomeDir: "./public",
+		Port:    "80",
+		ErrorPages: ErrorPages{
+			NotFound: "./public/404.html",
+			Internal: "./public/500.html",
+		},
+		DefaultIndexes:          []string{"index.html", "index.htm"},
+		Handlers:                make(map[string]HandlerConfig),
+		AccessLog:               "access.log",
+		ErrorLog:                "error.log",
+		HandlerLog:              "handler.log",
+		Compression:             CompressionConfig{Types: defaultCompressTypes},
+		MaxLogFiles:             5,
+		ETagHashLimit:           defaultETagHashLimit,
+		ShutdownTimeout:         5,
+		LogFormat:               "combined",
+		PrecompressedExtensions: defaultPrecompressedExtensions,
+		HealthPath:              "/healthz",
+		ReadyPath:               "/readyz",
+		DefaultContentType:      "text/html; charset=utf-8",
+		ServerSoftware:          "webexec-lite/" + version,
+		DirListTemplate:         "html/dirlist.html",
+		AllowedMethods:          []string{"GET", "HEAD", "POST"},
+		ForwardedProtoHeader:    "X-Forwarded-Proto",
+	}
+}
+
+// buildConfig layers the config file at path, when it exists, over the
+// built-in defaults.
+func buildConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if _, err := os.Stat(path); err != nil {
+		return cfg, nil
+	}
+	fileCfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if fileCfg.HomeDir != "" {
+		cfg.HomeDir = fileCfg.HomeDir
+	}
+	if fileCfg.Port != "" {
+		cfg.Port = fileCfg.Port
+	}
+	if fileCfg.ErrorPages.NotFound != "" {
+		cfg.ErrorPages.NotFound = fileCfg.ErrorPages.NotFound
+	}
+	if fileCfg.ErrorPages.Internal != "" {
+		cfg.ErrorPages.Internal = fileCfg.ErrorPages.Internal
+	}
+	cfg.ErrorPages.Forbidden = fileCfg.ErrorPages.Forbidden
+	cfg.ErrorPages.ServiceUnavailable = fileCfg.ErrorPages.ServiceUnavailable
+	if len(fileCfg.DefaultIndexes) > 0 {
+		cfg.DefaultIndexes = fileCfg.DefaultIndexes
+	}
+	if len(fileCfg.Handlers) > 0 {
+		cfg.Handlers = fileCfg.Handlers
+	}
+	cfg.PathHandlers = fileCfg.PathHandlers
+	if fileCfg.AccessLog != "" {
+		cfg.AccessLog = fileCfg.AccessLog
+	}
+	if fileCfg.ErrorLog != "" {
+		cfg.ErrorLog = fileCfg.ErrorLog
+	}
+	if fileCfg.HandlerLog != "" {
+		cfg.HandlerLog = fileCfg.HandlerLog
+	}
+	cfg.TLSCert = fileCfg.TLSCert
+	cfg.TLSKey = fileCfg.TLSKey
+	if fileCfg.TLSPort != "" {
+		cfg.TLSPort = fileCfg.TLSPort
+	}
+	cfg.RedirectHTTP = fileCfg.RedirectHTTP
+	cfg.HandlerTimeout = fileCfg.HandlerTimeout
+	cfg.Compression = fileCfg.Compression
+	cfg.Auth = fileCfg.Auth
+	cfg.MaxLogSize = fileCfg.MaxLogSize
+	if fileCfg.MaxLogFiles > 0 {
+		cfg.MaxLogFiles = fileCfg.MaxLogFiles
+	}
+	cfg.ETag = fileCfg.ETag
+	cfg.DirsFirst = fileCfg.DirsFirst
+	cfg.ShowHidden = fileCfg.ShowHidden
+	cfg.HiddenPatterns = fileCfg.HiddenPatterns
+	if fileCfg.ShutdownTimeout > 0 {
+		cfg.ShutdownTimeout = fileCfg.ShutdownTimeout
+	}
+	cfg.VirtualHosts = fileCfg.VirtualHosts
+	cfg.Headers = fileCfg.Headers
+	cfg.EnvWhitelist = fileCfg.EnvWhitelist
+	cfg.EnvExtra = fileCfg.EnvExtra
+	if fileCfg.ETagHashLimit > 0 {
+		cfg.ETagHashLimit = fileCfg.ETagHashLimit
+	}
+	cfg.MaxConcurrentHandlers = fileCfg.MaxConcurrentHandlers
+	cfg.QueueTimeout = fileCfg.QueueTimeout
+	if fileCfg.LogFormat != "" {
+		cfg.LogFormat = fileCfg.LogFormat
+	}
+	cfg.Listen = fileCfg.Listen
+	cfg.MimeTypes = fileCfg.MimeTypes
+	cfg.CORS = fileCfg.CORS
+	cfg.RateLimit = fileCfg.RateLimit
+	if fileCfg.PrecompressedExtensions != nil {
+		cfg.PrecompressedExtensions = fileCfg.PrecompressedExtensions
+	}
+	cfg.Proxies = fileCfg.Proxies
+	if fileCfg.HealthPath != "" {
+		cfg.HealthPath = fileCfg.HealthPath
+	}
+	if fileCfg.ReadyPath != "" {
+		cfg.ReadyPath = fileCfg.ReadyPath
+	}
+	cfg.LogHealthChecks = fileCfg.LogHealthChecks
+	cfg.Metrics = fileCfg.Metrics
+	if cfg.Metrics.Path == "" {
+		cfg.Metrics.Path = "/metrics"
+	}
+	if fileCfg.DefaultContentType != "" {
+		cfg.DefaultContentType = fileCfg.DefaultContentType
+	}
+	cfg.Nosniff = fileCfg.Nosniff
+	if fileCfg.ServerSoftware != "" {
+		cfg.ServerSoftware = fileCfg.ServerSoftware
+	}
+	cfg.ReadTimeout = fileCfg.ReadTimeout
+	cfg.ReadHeaderTimeout = fileCfg.ReadHeaderTimeout
+	cfg.WriteTimeout = fileCfg.WriteTimeout
+	cfg.IdleTimeout = fileCfg.IdleTimeout
+	cfg.Favicon = fileCfg.Favicon
+	cfg.RobotsTxt = fileCfg.RobotsTxt
+	if fileCfg.AutoIndex != nil {
+		cfg.AutoIndex = fileCfg.AutoIndex
+	}
+	cfg.AutoIndexPaths = fileCfg.AutoIndexPaths
+	cfg.AllowIPs = fileCfg.AllowIPs
+	cfg.DenyIPs = fileCfg.DenyIPs
+	cfg.IPRules = fileCfg.IPRules
+	cfg.TrustedProxies = fileCfg.TrustedProxies
+	cfg.DebugHandlerErrors = fileCfg.DebugHandlerErrors
+	cfg.LogExclude = fileCfg.LogExclude
+	if fileCfg.ServerHeader != nil {
+		cfg.ServerHeader = fileCfg.ServerHeader
+	}
+	cfg.FollowSymlinks = fileCfg.FollowSymlinks
+	if fileCfg.DirListTemplate != "" {
+		cfg.DirListTemplate = fileCfg.DirListTemplate
+	}
+	cfg.DevMode = fileCfg.DevMode
+	cfg.IndexPaths = fileCfg.IndexPaths
+	cfg.HandlerStrictPerms = fileCfg.HandlerStrictPerms
+	cfg.Mounts = fileCfg.Mounts
+	cfg.CacheControl = fileCfg.CacheControl
+	if len(fileCfg.AllowedMethods) > 0 {
+		cfg.AllowedMethods = fileCfg.AllowedMethods
+	}
+	cfg.HandlerBufferSize = fileCfg.HandlerBufferSize
+	cfg.TCPKeepAlive = fileCfg.TCPKeepAlive
+	cfg.MaxHeaderBytes = fileCfg.MaxHeaderBytes
+	if fileCfg.ListingShowSize != nil {
+		cfg.ListingShowSize = fileCfg.ListingShowSize
+	}
+	if fileCfg.ListingShowModTime != nil {
+		cfg.ListingShowModTime = fileCfg.ListingShowModTime
+	}
+	cfg.StrictEnv = fileCfg.StrictEnv
+	cfg.ListingTitle = fileCfg.ListingTitle
+	cfg.ListingHeaderHTML = fileCfg.ListingHeaderHTML
+	cfg.ListingFooterHTML = fileCfg.ListingFooterHTML
+	if fileCfg.ForwardedProtoHeader != "" {
+		cfg.ForwardedProtoHeader = fileCfg.ForwardedProtoHeader
+	}
+	cfg.EnableH2C = fileCfg.EnableH2C
+	cfg.ErrorPagesMap = fileCfg.ErrorPagesMap
+	cfg.HandlerLogFormat = fileCfg.HandlerLogFormat
+	cfg.SPAFallback = fileCfg.SPAFallback
+	cfg.MaxConnections = fileCfg.MaxConnections
+	cfg.ListingPageSize = fileCfg.ListingPageSize
+	cfg.RequestTimeout = fileCfg.RequestTimeout
+	cfg.LogTimeFormat = fileCfg.LogTimeFormat
+	cfg.LogTimeUTC = fileCfg.LogTimeUTC
+	if len(cfg.Compression.Types) == 0 {
+		cfg.Compression.Types = defaultCompressTypes
+	}
+	return cfg, nil
+}
+
+// errorPagePath returns the page configured for status code: the
+// error_pages_map entry, else the matching error_pages field. 429 shares the
+// 503 page unless it has its own.
+func errorPagePath(cfg *Config, code int) string {
+	if page, ok := cfg.ErrorPagesMap[strconv.Itoa(code)]; ok {
+		return page
+	}
+	switch code {
+	case http.StatusNotFound:
+		return cfg.ErrorPages.NotFound
+	case http.StatusInternalServerError:
+		return cfg.ErrorPages.Internal
+	case http.StatusForbidden:
+		return cfg.ErrorPages.Forbidden
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		return cfg.ErrorPages.ServiceUnavailable
+	}
+	return ""
+}
+
+// serveErrorPage writes code with the body errorPageBody returns for it.
+func serveErrorPage(w http.ResponseWriter, cfg *Config, code int, defaultMsg string) {
 	w.WriteHeader(code)
-	if pagePath != "" {
+	w.Write(errorPageBody(cfg, code, defaultMsg))
+}
+
+// errorPageBody returns the configured error page for code, or defaultMsg
+// when there is none or it can't be read.
+func errorPageBody(cfg *Config, code int, defaultMsg string) []byte {
+	if pagePath := errorPagePath(cfg, code); pagePath != "" {
 		if data, err := ioutil.ReadFile(pagePath); err == nil {
-			w.Write(data)
-			return
+			return data
 		}
 	}
-	w.Write([]byte(defaultMsg))
+	return []byte(defaultMsg)
 }
 
-func tryServeIndex(w http.ResponseWriter, r *http.Request, dirPath string, indexes []string) bool {
-	for _, idx := range indexes {
-		indexPath := filepath.Join(dirPath, idx)
-		if stat, err := os.Stat(indexPath); err == nil && !stat.IsDir() {
-			http.ServeFile(w, r, indexPath)
-			return true
+// resolvePath maps an escaped request path onto root. It reports false when the
+// decoded path escapes root or, unless followSymlinks is set, when the target
+// of a symlink along it does.
+func resolvePath(root, escapedPath string, followSymlinks bool) (string, bool) {
+	decoded, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return "", false
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", false
+	}
+	full := filepath.Join(absRoot, filepath.FromSlash(decoded))
+	if !withinDir(absRoot, full) {
+		return "", false
+	}
+	if followSymlinks {
+		return full, true
+	}
+	if real, err := filepath.EvalSymlinks(full); err == nil {
+		realRoot, err := filepath.EvalSymlinks(absRoot)
+		if err != nil || !withinDir(realRoot, real) {
+			return "", false
 		}
 	}
-	return false
+	return full, true
+}
+
+func withinDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func matchesPrefix(urlPath, prefix string) bool {
+	if !strings.HasPrefix(urlPath, prefix) {
+		return false
+	}
+	return len(urlPath) == len(prefix) || strings.HasSuffix(prefix, "/") || urlPath[len(prefix)] == '/'
+}
+
+// applyCustomHeaders sets the configured headers for every prefix matching
+// urlPath ("*" matches all), broadest first so more specific prefixes win.
+// An empty value removes the header.
+func applyCustomHeaders(h http.Header, rules map[string]map[string]string, urlPath string) {
+	var prefixes []string
+	for prefix := range rules {
+		if prefix == "*" || matchesPrefix(urlPath, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i] == "*" || prefixes[j] == "*" {
+			return prefixes[i] == "*" && prefixes[j] != "*"
+		}
+		return len(prefixes[i]) < len(prefixes[j])
+	})
+	for _, prefix := range prefixes {
+		for name, value := range rules[prefix] {
+			if value == "" {
+				h.Del(name)
+			} else {
+				h.Set(name, value)
+			}
+		}
+	}
+}
+
+// longestPrefix returns the entry of m whose key is the longest URL path
+// prefix of urlPath. A key matches only at a path segment boundary, so
+// "/admin" covers "/admin/x" but not "/administrator".
+func longestPrefix[T any](m map[string]T, urlPath string) (string, T, bool) {
+	var best string
+	var val T
+	found := false
+	for prefix, v := range m {
+		if !matchesPrefix(urlPath, prefix) {
+			continue
+		}
+		if !found || len(prefix) > len(best) {
+			best, val, found = prefix, v, true
+		}
+	}
+	return best, val, found
+}
+
+// maxDrainBytes bounds how much of an unread request body drainBody reads.
+// Past that the connection is closed instead, which is cheaper than reading
+// an upload nobody wants.
+const maxDrainBytes = 1 << 20
+
+// drainBody reads and discards what is left of the request body so a
+// keep-alive client can send its next request on the same connection. Call it
+// before writing an error response that leaves the body unread: once the
+// response has started, HTTP/1.x may refuse further body reads. Requests
+// waiting on "Expect: 100-continue" have not sent their body and are skipped.
+func drainBody(r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody || strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		return
+	}
+	io.CopyN(io.Discard, r.Body, maxDrainBytes)
+	r.Body.Close()
+}
+
+// requestMethodAllowed checks r.Method against allowed_methods ("*" allows
+// any). Proxied requests are forwarded with whatever method they have, and a
+// handler that lists its own methods decides for itself, so their routes skip
+// the global list. It returns the list that rejected the request.
+func requestMethodAllowed(cfg *Config, r *http.Request) ([]string, bool) {
+	if slices.Contains(cfg.AllowedMethods, "*") || methodAllowed(cfg.AllowedMethods, r.Method) {
+		return nil, true
+	}
+	if _, _, ok := longestPrefix(cfg.Proxies, r.URL.Path); ok {
+		return nil, true
+	}
+	if _, h, ok := longestPrefix(cfg.PathHandlers, r.URL.Path); ok {
+		return cfg.AllowedMethods, len(h.Methods) > 0
+	}
+	if h, ok := cfg.Handlers[strings.ToLower(path.Ext(r.URL.Path))]; ok && len(h.Methods) > 0 {
+		return nil, true
+	}
+	if _, _, _, h, ok := splitScriptPath(cfg, r.URL.Path); ok && len(h.Methods) > 0 {
+		return nil, true
+	}
+	return cfg.AllowedMethods, false
+}
+
+// isHandlerRoute reports whether urlPath is served by a path or extension
+// handler (directory index handlers are not considered).
+func isHandlerRoute(cfg *Config, urlPath string) bool {
+	if _, _, ok := longestPrefix(cfg.PathHandlers, urlPath); ok {
+		return true
+	}
+	_, ok := cfg.Handlers[strings.ToLower(path.Ext(urlPath))]
+	return ok
+}
+
+// mimeOverride returns the configured Content-Type for path's extension, if
+// any. Keys may be given with or without the leading dot.
+func mimeOverride(types map[string]string, path string) string {
+	if len(types) == 0 {
+		return ""
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	for key, ctype := range types {
+		if !strings.HasPrefix(key, ".") {
+			key = "." + key
+		}
+		if strings.EqualFold(key, ext) {
+			return ctype
+		}
+	}
+	return ""
+}
+
+// cacheControlFor returns the Cache-Control value configured for a static
+// file: an exact ".ext" key wins, then the longest glob matching the file
+// name, so "*" acts as the fallback.
+func cacheControlFor(rules map[string]string, name string) string {
+	base := path.Base(name)
+	ext := path.Ext(base)
+	var best, value string
+	for pattern, v := range rules {
+		if strings.HasPrefix(pattern, ".") {
+			if ext != "" && strings.EqualFold(pattern, ext) {
+				return v
+			}
+			continue
+		}
+		if len(pattern) > len(best) {
+			if ok, _ := path.Match(pattern, base); ok {
+				best, value = pattern, v
+			}
+		}
+	}
+	return value
+}
+
+// serveStatic serves the regular file name from site. http.ServeContent
+// handles Range, Last-Modified and, once the ETag header is set,
+// If-None-Match.
+func serveStatic(w http.ResponseWriter, r *http.Request, cfg *Config, site FileSystem, name string) {
+	if ctype := mimeOverride(cfg.MimeTypes, name); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	if cc := cacheControlFor(cfg.CacheControl, name); cc != "" && w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	if variant, coding := precompressedVariant(w, r, site, cfg.PrecompressedExtensions, name); variant != "" {
+		if servePrecompressed(w, r, cfg, site, name, variant, coding) {
+			return
+		}
+	}
+	f, err := site.Open(name)
+	if err != nil {
+		serveErrorPage(w, cfg, 404, "404 page not found")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		serveErrorPage(w, cfg, 500, "500 Internal Server Error")
+		return
+	}
+	if cfg.ETag {
+		if tag, err := fileETag(site, name, info, cfg.ETagHashLimit); err == nil {
+			w.Header().Set("ETag", tag)
+		}
+	}
+	// Bytes are counted by the StatusWriter rather than by wrapping f, which
+	// would hide the *os.File from sendfile.
+	http.ServeContent(w, r, name, info.ModTime(), f)
 }
 
 func isExecutable(path string) bool {
@@ -83,6 +711,23 @@ func isExecutable(path string) bool {
 	return mode&0111 != 0 // any execute bit set
 }
 
+// handlerPermsProblem explains why the handler command at path is unsafe to
+// run under handler_strict_perms: writable by group or others, or owned by a
+// user other than the server's. It returns "" when the file passes.
+func handlerPermsProblem(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err.Error()
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Sprintf("writable by group or others (mode %04o)", info.Mode().Perm())
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Sprintf("owned by uid %d, not %d", st.Uid, os.Getuid())
+	}
+	return ""
+}
+
 func resolveHandlerCommand(cmdPath string) string {
 	if filepath.IsAbs(cmdPath) {
 		return cmdPath
@@ -94,31 +739,112 @@ func resolveHandlerCommand(cmdPath string) string {
 	return abs
 }
 
-func handleWithExternal(w http.ResponseWriter, r *http.Request, handler HandlerConfig, filePath string, handlerLogger *log.Logger) {
-	cmdPath := resolveHandlerCommand(handler.Command)
-	if !isExecutable(cmdPath) {
-		w.WriteHeader(500)
-		w.Write([]byte("Handler executable not found or not executable: " + cmdPath))
-		if handlerLogger != nil {
-			handlerLogger.Printf("%s | %s | %v | %s | %s %s | %s | status=%d", time.Now().Format(time.RFC3339), cmdPath, handler.Args, filePath, r.Method, r.URL.RequestURI(), r.RemoteAddr, 500)
+func methodAllowed(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
 		}
-		return
 	}
-	args := make([]string, len(handler.Args))
-	for i, arg := range handler.Args {
-		args[i] = strings.ReplaceAll(arg, "{filepath}", filePath)
+	return false
+}
+
+// handlerBaseEnv returns the host environment passed to handlers: all of it
+// when whitelist is empty, otherwise only the listed variables.
+func handlerBaseEnv(whitelist []string) []string {
+	if len(whitelist) == 0 {
+		return os.Environ()
+	}
+	var env []string
+	for _, name := range whitelist {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
 	}
-	cmd := exec.Command(cmdPath, args...)
+	return env
+}
 
-	// Set up CGI environment variables
-	env := os.Environ()
+// describeExit explains why a handler run failed: its exit code, the signal
+// that killed it, or the error that kept it from starting.
+func describeExit(err error) string {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return "failed: " + err.Error()
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		desc := fmt.Sprintf("killed by signal %d (%s)", int(ws.Signal()), ws.Signal())
+		if ws.CoreDump() {
+			desc += ", core dumped"
+		}
+		return desc
+	}
+	return fmt.Sprintf("exited with code %d", exitErr.ExitCode())
+}
+
+// firstLine returns the first non-empty line of output, trimmed to 200 bytes.
+func firstLine(output []byte) string {
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			if len(line) > 200 {
+				line = line[:200] + "..."
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// acquireHandlerSlot takes a slot from sem. If none frees up within the queue
+// timeout it answers 503 and reports false.
+func acquireHandlerSlot(w http.ResponseWriter, r *http.Request, cfg *Config, sem semaphore, run *handlerRun) bool {
+	waited, ok := sem.acquire(r.Context(), time.Duration(cfg.QueueTimeout)*time.Second)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		drainBody(r)
+		serveErrorPage(w, cfg, 503, "503 too many concurrent handler requests")
+		run.event(fmt.Sprintf("rejected after queueing %s", waited.Round(time.Millisecond)))
+		run.finish(503)
+		return false
+	}
+	if waited > 0 {
+		run.event(fmt.Sprintf("queued %s", waited.Round(time.Millisecond)))
+	}
+	return true
+}
+
+// cgiEnv returns the CGI request variables describing r, shared by exec and
+// FastCGI handlers. scriptName is the URL path of the script itself and
+// pathInfo the rest of the request path after it (RFC 3875, section 4.1).
+func cgiEnv(r *http.Request, cfg *Config, filePath, scriptName, pathInfo string) []string {
+	var env []string
 	env = append(env, "REQUEST_METHOD="+r.Method)
 	env = append(env, "QUERY_STRING="+r.URL.RawQuery)
 	env = append(env, "CONTENT_TYPE="+r.Header.Get("Content-Type"))
 	env = append(env, "CONTENT_LENGTH="+r.Header.Get("Content-Length"))
-	env = append(env, "SCRIPT_NAME="+r.URL.Path)
-	env = append(env, "PATH_INFO="+filePath)
-	env = append(env, "REMOTE_ADDR="+r.RemoteAddr)
+	env = append(env, "SCRIPT_NAME="+scriptName)
+	if abs, err := filepath.Abs(filePath); err == nil {
+		filePath = abs
+	}
+	env = append(env, "SCRIPT_FILENAME="+filePath)
+	env = append(env, "REDIRECT_STATUS=200") // php-cgi refuses to run without it (cgi.force_redirect)
+	env = append(env, "PATH_INFO="+pathInfo)
+	if pathInfo != "" {
+		// PATH_INFO is mapped like a URL path, so under a mount the prefix
+		// goes before joining it to the mount's root.
+		if root, err := filepath.Abs(cfg.HomeDir); err == nil {
+			env = append(env, "PATH_TRANSLATED="+filepath.Join(root, filepath.FromSlash(sitePath(cfg, pathInfo))))
+		}
+	}
+	client := requestClientIP(r)
+	env = append(env, "REMOTE_ADDR="+client)
+	env = append(env, "REMOTE_HOST="+client)
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil && host == client {
+		env = append(env, "REMOTE_PORT="+port)
+	}
+	env = append(env, "GATEWAY_INTERFACE=CGI/1.1")
+	env = append(env, "SERVER_SOFTWARE="+cfg.ServerSoftware)
 
 	// Pass all HTTP headers as environment variables (HTTP_HEADERNAME)
 	for name, values := range r.Header {
@@ -130,6 +856,9 @@ func handleWithExternal(w http.ResponseWriter, r *http.Request, handler HandlerC
 
 	// Pass Host
 	env = append(env, "HTTP_HOST="+r.Host)
+	if r.Header.Get("X-Request-ID") == "" {
+		env = append(env, "HTTP_X_REQUEST_ID="+requestID(r))
+	}
 
 	// Pass cookies as HTTP_COOKIE (already included in headers, but explicit)
 	if cookieHeader := r.Header.Get("Cookie"); cookieHeader != "" {
@@ -139,125 +868,525 @@ func handleWithExternal(w http.ResponseWriter, r *http.Request, handler HandlerC
 	// Pass protocol
 	env = append(env, "SERVER_PROTOCOL="+r.Proto)
 
+	scheme := requestScheme(r, cfg)
+	env = append(env, "REQUEST_SCHEME="+scheme)
+	if scheme == "https" {
+		env = append(env, "HTTPS=on")
+	}
+
 	// Pass server name and port
 	if host, port, err := net.SplitHostPort(r.Host); err == nil {
 		env = append(env, "SERVER_NAME="+host)
 		env = append(env, "SERVER_PORT="+port)
 	} else {
 		env = append(env, "SERVER_NAME="+r.Host)
+		if scheme == "https" {
+			env = append(env, "SERVER_PORT=443")
+		} else {
+			env = append(env, "SERVER_PORT=80")
+		}
 	}
 
 	// Pass request URI
 	env = append(env, "REQUEST_URI="+r.RequestURI)
+	return env
+}
 
+// writeHandlerOutput sends a handler's output, honouring any leading CGI
+// header block, and returns the status written.
+func writeHandlerOutput(w http.ResponseWriter, r *http.Request, cfg *Config, output []byte) int {
+	status, body := applyHandlerHeaders(w, output)
+	if status == 200 && handlerNotModified(r, w.Header()) {
+		h := w.Header()
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return http.StatusNotModified
+	}
+	// A handler that declares Content-Length has produced a complete,
+	// definite-length entity, so byte ranges can be served from it.
+	if w.Header().Get("Content-Length") != "" {
+		w.Header().Set("Accept-Ranges", "bytes")
+		body, status = applyByteRange(w, r, body, status)
+	}
+	// Add Content-Type header if it's not set
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", cfg.DefaultContentType)
+	}
+	// The whole body is buffered, so send a definite length rather than
+	// letting large responses fall back to chunked encoding.
+	if w.Header().Get("Content-Length") == "" && status != http.StatusNoContent && status >= 200 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+	return status
+}
+
+// applyHandlerHeaders copies any CGI header block at the start of output onto
+// w and returns the status it asks for (200 by default) and the body after it.
+func applyHandlerHeaders(w http.ResponseWriter, output []byte) (int, []byte) {
+	header, code, rest, ok := parseCGIResponse(output)
+	if !ok {
+		return 200, output
+	}
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	if code == 0 {
+		code = 200
+	}
+	return code, rest
+}
+
+// serveFastCGI forwards r to the FastCGI backend at address and writes its
+// response through stdout, returning the status sent.
+func serveFastCGI(w http.ResponseWriter, r *http.Request, cfg *Config, address string, reqEnv []string, stdout *spillWriter, timeout time.Duration, run *handlerRun) int {
+	var env []string
+	for name, value := range cfg.EnvExtra {
+		env = append(env, name+"="+value)
+	}
+	env = append(env, reqEnv...)
+	stderr, err := fastcgiRoundTrip(r.Context(), address, env, r.Body, stdout, timeout)
+	if len(stderr) > 0 {
+		run.stderr = firstLine(stderr)
+		run.event("stderr: " + strings.TrimSpace(string(stderr)))
+	}
+	if stdout.streamed() {
+		// Headers are gone already; all that is left is to record how it ended.
+		switch {
+		case errors.Is(err, context.Canceled):
+			run.event("killed: client disconnected")
+		case err != nil:
+			run.event("fastcgi error after the response was sent: " + err.Error())
+		}
+		return stdout.status
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			// Nobody is left to answer; 499 marks it in the access log.
+			w.WriteHeader(statusClientClosedRequest)
+			run.event("killed: client disconnected")
+			return statusClientClosedRequest
+		}
+		var nerr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout()) {
+			serveErrorPage(w, cfg, 504, "Handler timed out")
+			return 504
+		}
+		run.event("fastcgi error: " + err.Error())
+		serveErrorPage(w, cfg, 502, "502 FastCGI backend unavailable")
+		return 502
+	}
+	return writeHandlerOutput(w, r, cfg, stdout.buf.Bytes())
+}
+
+// argReplacer substitutes the placeholders allowed in handler args. Values
+// are inserted in a single pass, so a placeholder inside a query string is
+// not expanded again. Each arg reaches the command as one argv entry with no
+// shell in between, but a value can still make an arg look like an option;
+// handleWithExternal refuses those.
+func argReplacer(r *http.Request, filePath string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{filepath}", filePath,
+		"{path}", r.URL.Path,
+		"{query}", r.URL.RawQuery,
+		"{method}", r.Method,
+		"{remote}", requestClientIP(r),
+		"{ext}", strings.ToLower(filepath.Ext(filePath)),
+	)
+}
+
+// statusClientClosedRequest is nginx's code for a request the client gave up
+// on before the response was ready.
+const statusClientClosedRequest = 499
+
+func handleWithExternal(w http.ResponseWriter, r *http.Request, cfg *Config, handler HandlerConfig, route, filePath, scriptName, pathInfo string, handlerLogger *log.Logger) {
+	fastcgi := handler.Type == "fastcgi"
+	cmdPath := handler.Address
+	if !fastcgi {
+		cmdPath = resolveHandlerCommand(handler.Command)
+	}
+	run := newHandlerRun(handlerLogger, cfg, r, cmdPath, handler.Args, filePath, route)
+	if !methodAllowed(handler.Methods, r.Method) {
+		drainBody(r)
+		w.Header().Set("Allow", strings.ToUpper(strings.Join(handler.Methods, ", ")))
+		w.WriteHeader(405)
+		w.Write([]byte("405 method not allowed"))
+		run.finish(405)
+		return
+	}
+	if !fastcgi && !isExecutable(cmdPath) {
+		// A deployment problem rather than a failing script: answer 502 so
+		// the two are easy to tell apart.
+		drainBody(r)
+		serveErrorPage(w, cfg, 502, "Handler executable not found or not executable: "+cmdPath)
+		run.event("spawn failed: not found or not executable")
+		run.finish(502)
+		metrics.observeHandler(502, false)
+		return
+	}
+	if !fastcgi && cfg.HandlerStrictPerms {
+		if problem := handlerPermsProblem(cmdPath); problem != "" {
+			drainBody(r)
+			serveErrorPage(w, cfg, 500, "500 Internal Server Error")
+			run.event("refused: " + problem)
+			run.finish(500)
+			metrics.observeHandler(500, false)
+			return
+		}
+	}
+	if cfg.MaxConcurrentHandlers > 0 {
+		sem := getSemaphore("global", cfg.MaxConcurrentHandlers)
+		if !acquireHandlerSlot(w, r, cfg, sem, run) {
+			return
+		}
+		defer sem.release()
+	}
+	if handler.MaxConcurrent > 0 {
+		// Keyed by the extension or prefix, not the command, so routes
+		// sharing a binary keep their own limits.
+		sem := getSemaphore("handler:"+route, handler.MaxConcurrent)
+		if !acquireHandlerSlot(w, r, cfg, sem, run) {
+			return
+		}
+		defer sem.release()
+	}
+	// With no configured args the command runs bare, the way CGI programs
+	// such as php-cgi expect; they find the script via SCRIPT_FILENAME.
+	var args []string
+	if len(handler.Args) > 0 {
+		args = make([]string, len(handler.Args))
+		placeholders := argReplacer(r, filePath)
+		for i, arg := range handler.Args {
+			args[i] = placeholders.Replace(arg)
+			if strings.HasPrefix(args[i], "-") && !strings.HasPrefix(arg, "-") {
+				// e.g. "{query}" with ?-rf, which the command would read
+				// as an option.
+				drainBody(r)
+				serveErrorPage(w, cfg, http.StatusBadRequest, "400 Bad Request")
+				run.event("refused: request turns arg " + strconv.Quote(arg) + " into an option")
+				run.finish(http.StatusBadRequest)
+				metrics.observeHandler(http.StatusBadRequest, false)
+				return
+			}
+		}
+	}
+	run.args = args
+	timeout := handler.Timeout
+	if timeout == 0 {
+		timeout = cfg.HandlerTimeout
+	}
+	// Output beyond the buffer size is streamed, so it is never held in
+	// memory in full.
+	limit := cfg.HandlerBufferSize
+	if limit <= 0 {
+		limit = defaultHandlerBufferSize
+	}
+	stdout := &spillWriter{w: w, r: r, cfg: cfg, limit: limit, stream: handler.Stream}
+	if fastcgi {
+		status := serveFastCGI(w, r, cfg, cmdPath, append(cgiEnv(r, cfg, filePath, scriptName, pathInfo), routeEnv(route)...), stdout, time.Duration(timeout)*time.Second, run)
+		run.finish(status)
+		metrics.observeHandler(status, true)
+		return
+	}
+	// The process is killed when the client goes away or the timeout hits,
+	// whichever comes first.
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, cmdPath, args...)
+	cmd.WaitDelay = time.Second // don't wait on pipes held open by orphaned children
+
+	// Set up CGI environment variables
+	env := handlerBaseEnv(cfg.EnvWhitelist)
+	for name, value := range cfg.EnvExtra {
+		env = append(env, name+"="+value)
+	}
+	env = append(env, cgiEnv(r, cfg, filePath, scriptName, pathInfo)...)
+	env = append(env, routeEnv(route)...)
 	cmd.Env = env
 
+	// The request body is copied to stdin as the handler reads it.
 	cmd.Stdin = r.Body
-	output, err := cmd.CombinedOutput() // Capture both stdout and stderr
-	status := 200
-	if err != nil {
-		w.WriteHeader(500)
-		w.Write(output) // Show the actual error output from the handler
+	var errBuf bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &errBuf
+	err := runningHandlers.run(cmd)
+	output := stdout.buf.Bytes()
+	var status int
+	started := cmd.Process != nil
+	if started {
+		run.exited(err, errBuf.Bytes())
+	}
+	if errors.Is(err, errDraining) {
+		serveErrorPage(w, cfg, 503, "503 server shutting down")
+		status = 503
+		run.event("refused: server shutting down")
+	} else if err != nil && !started {
+		serveErrorPage(w, cfg, 502, "502 Bad Gateway")
+		status = 502
+		run.event("spawn failed: " + err.Error())
+	} else if stdout.streamed() {
+		// Headers are gone already; all that is left is to record how it ended.
+		status = stdout.status
+		if err != nil {
+			event := describeExit(err) + " after the response was sent"
+			switch ctx.Err() {
+			case context.DeadlineExceeded:
+				event = "timed out after the response was sent"
+			case context.Canceled:
+				event = "killed: client disconnected"
+			}
+			run.event(event)
+		}
+		if errBuf.Len() > 0 {
+			run.event("stderr: " + strings.TrimSpace(errBuf.String()))
+		}
+	} else if err != nil && ctx.Err() == context.Canceled {
+		// Nobody is left to answer; 499 marks it in the access log.
+		status = statusClientClosedRequest
+		w.WriteHeader(status)
+		run.event("killed: client disconnected")
+	} else if err != nil && ctx.Err() == context.DeadlineExceeded {
+		serveErrorPage(w, cfg, 504, "Handler timed out")
+		status = 504
+	} else if err != nil {
 		status = 500
+		if cfg.DebugHandlerErrors {
+			w.WriteHeader(500)
+			if len(output) == 0 {
+				output = errBuf.Bytes()
+			}
+			w.Write(output) // Show the actual error output from the handler
+		} else {
+			serveErrorPage(w, cfg, 500, "500 Internal Server Error")
+		}
+		event := describeExit(err)
+		if line := firstLine(errBuf.Bytes()); line != "" {
+			event += " | stderr: " + line
+		}
+		run.event(event)
 	} else {
-		// Add Content-Type header if it's not set
-		if w.Header().Get("Content-Type") == "" {
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		status = writeHandlerOutput(w, r, cfg, output)
+		if errBuf.Len() > 0 {
+			run.event("stderr: " + strings.TrimSpace(errBuf.String()))
 		}
-		w.Write(output)
 	}
-	if handlerLogger != nil {
-		handlerLogger.Printf("%s | %s | %v | %s | %s %s | %s | status=%d", time.Now().Format(time.RFC3339), cmdPath, args, filePath, r.Method, r.URL.RequestURI(), r.RemoteAddr, status)
+	run.finish(status)
+	metrics.observeHandler(status, started)
+}
+
+// routeEnv tells a handler which configured route matched it: the
+// handlers extension or the path_handlers prefix.
+func routeEnv(route string) []string {
+	env := []string{"WEBEXEC_ROUTE=" + route}
+	if strings.HasPrefix(route, ".") {
+		env = append(env, "WEBEXEC_HANDLER_EXT="+route)
+	}
+	return env
+}
+
+// indexNames returns the index file names to try for the directory urlPath:
+// the longest matching index_paths prefix, else default_indexes.
+func indexNames(cfg *Config, urlPath string) []string {
+	if _, names, ok := longestPrefix(cfg.IndexPaths, urlPath); ok {
+		return names
 	}
+	return cfg.DefaultIndexes
 }
 
-func tryServeIndexWithHandler(w http.ResponseWriter, r *http.Request, dirPath string, indexes []string, handlers map[string]HandlerConfig) bool {
-	for _, idx := range indexes {
-		indexPath := filepath.Join(dirPath, idx)
-		if stat, err := os.Stat(indexPath); err == nil && !stat.IsDir() {
-			ext := strings.ToLower(filepath.Ext(indexPath))
-			if handler, ok := handlers[ext]; ok {
-				handleWithExternal(w, r, handler, indexPath, nil) // Pass nil for handlerLogger as it's not used here
-				return true
-			}
-			http.ServeFile(w, r, indexPath)
-			return true
+// Server timeouts used when the config leaves them at 0. A negative value in
+// the config disables the timeout.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 60 * time.Second
+	defaultWriteTimeout      = 0 // whole-response limit; would cut off large downloads
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+func serverTimeout(seconds int, def time.Duration) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// listen opens a TCP listener on addr with the configured keep-alive period
+// applied to accepted connections. The accept backlog is left to Go, which
+// uses the system maximum (net.core.somaxconn on Linux).
+func listen(addr string, cfg *Config) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: time.Duration(cfg.TCPKeepAlive) * time.Second}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// newHTTPServer returns an http.Server for addr with the configured timeouts,
+// header size limit and protocols.
+func newHTTPServer(addr string, cfg *Config) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: serverTimeout(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       serverTimeout(cfg.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      serverTimeout(cfg.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       serverTimeout(cfg.IdleTimeout, defaultIdleTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.EnableH2C {
+		// HTTP/2 over TLS stays on; h2c is added next to HTTP/1.1.
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
+
+// setServerHeader sends the configured Server header; an explicit empty
+// server_header leaves it out.
+func setServerHeader(w http.ResponseWriter, cfg *Config) {
+	name := "webexec-lite/" + version
+	if cfg.ServerHeader != nil {
+		name = *cfg.ServerHeader
+	}
+	if name != "" {
+		w.Header().Set("Server", name)
+	}
+}
+
+// redirectToHTTPS answers every request with a 301 to the https:// equivalent
+// URL, passing requests a trusted proxy already received over HTTPS to
+// server. It reads server's config on each request, so a reload applies.
+func redirectToHTTPS(server *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := server.Config()
+		// Behind a TLS-terminating proxy the client is already on HTTPS.
+		if requestScheme(r, cfg) == "https" {
+			server.ServeHTTP(w, r)
+			return
 		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort := cfg.TLSPort; tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		setServerHeader(w, cfg)
+		ww := &StatusWriter{ResponseWriter: w, Status: 200, Start: time.Now()}
+		http.Redirect(ww, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		LogAccess(r, ww, server.accessLogger, cfg.LogFormat)
 	}
-	return false
 }
 
 // Remove the local renderDirList function from main.go and use RenderDirList from logutil.go
 
 func main() {
-	configPath := flag.String("config", "config.json", "Path to config file")
+	configPath := flag.String("config", "config.json", "Path to config file, or a directory of *.json files to merge")
 	homeDirFlag := flag.String("homedir", "", "Directory to serve static files from")
 	portFlag := flag.String("port", "", "Port to serve HTTP on")
+	versionFlag := flag.Bool("version", false, "Print version information and exit")
+	checkFlag := flag.Bool("check", false, "Validate the config and exit")
+	testRequestFlag := flag.String("test-request", "", "Print how `METHOD` and the path or URL after the flags would be routed, and exit")
 	flag.Parse()
 
-	cfg := &Config{
-		HomeDir: "./public",
-		Port:    "80",
-		ErrorPages: ErrorPages{
-			NotFound: "./public/404.html",
-			Internal: "./public/500.html",
-		},
-		DefaultIndexes: []string{"index.html", "index.htm"},
-		Handlers:       make(map[string]HandlerConfig),
+	if *versionFlag {
+		fmt.Printf("webexec-lite %s (commit %s, built %s)\n", version, commit, buildDate)
+		return
 	}
 
-	if _, err := os.Stat(*configPath); err == nil {
-		if fileCfg, err := loadConfig(*configPath); err == nil {
-			if fileCfg.HomeDir != "" {
-				cfg.HomeDir = fileCfg.HomeDir
-			}
-			if fileCfg.Port != "" {
-				cfg.Port = fileCfg.Port
-			}
-			if fileCfg.ErrorPages.NotFound != "" {
-				cfg.ErrorPages.NotFound = fileCfg.ErrorPages.NotFound
-			}
-			if fileCfg.ErrorPages.Internal != "" {
-				cfg.ErrorPages.Internal = fileCfg.ErrorPages.Internal
-			}
-			if len(fileCfg.DefaultIndexes) > 0 {
-				cfg.DefaultIndexes = fileCfg.DefaultIndexes
-			}
-			if len(fileCfg.Handlers) > 0 {
-				cfg.Handlers = fileCfg.Handlers
-			}
-			if fileCfg.AccessLog != "" {
-				cfg.AccessLog = fileCfg.AccessLog
-			}
-			if fileCfg.ErrorLog != "" {
-				cfg.ErrorLog = fileCfg.ErrorLog
-			}
-			if fileCfg.HandlerLog != "" {
-				cfg.HandlerLog = fileCfg.HandlerLog
-			}
+	applyFlags := func(cfg *Config) {
+		if *homeDirFlag != "" {
+			cfg.HomeDir = *homeDirFlag
+		}
+		if *portFlag != "" {
+			cfg.Port = *portFlag
+			cfg.Listen = nil
 		}
 	}
-
-	if *homeDirFlag != "" {
-		cfg.HomeDir = *homeDirFlag
+	cfg, err := buildConfig(*configPath)
+	if err != nil {
+		fmt.Println("Failed to load config", *configPath+":", err)
+		os.Exit(1)
 	}
-	if *portFlag != "" {
-		cfg.Port = *portFlag
+	applyFlags(cfg)
+	problems, warnings := validateConfig(cfg)
+	for _, w := range warnings {
+		fmt.Println("Warning:", w)
 	}
-
-	addr := ":" + cfg.Port
-	server := &http.Server{Addr: addr}
-
-	accessLogPath := "access.log"
-	errorLogPath := "error.log"
-	if cfg.AccessLog != "" {
-		accessLogPath = cfg.AccessLog
+	for _, p := range problems {
+		fmt.Println("Config error:", p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	if *checkFlag {
+		fmt.Println("Config OK")
+		return
+	}
+	if *testRequestFlag != "" {
+		method, target, _ := strings.Cut(*testRequestFlag, " ")
+		if target == "" {
+			target = flag.Arg(0)
+		}
+		if target == "" {
+			fmt.Println("-test-request needs a path, e.g. -test-request GET /index.html")
+			os.Exit(2)
+		}
+		if err := printRoute(os.Stdout, cfg, method, target); err != nil {
+			fmt.Println("Invalid request:", err)
+			os.Exit(2)
+		}
+		return
+	}
+	addrs := cfg.Listen
+	if len(addrs) == 0 {
+		addrs = []string{":" + cfg.Port}
 	}
-	if cfg.ErrorLog != "" {
-		errorLogPath = cfg.ErrorLog
+	// Bind every address up front so a failure stops startup instead of
+	// leaving the server half up.
+	var servers []*http.Server
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		ln, err := listen(addr, cfg)
+		if err != nil {
+			fmt.Println("Failed to listen on", addr+":", err)
+			os.Exit(1)
+		}
+		servers = append(servers, newHTTPServer(addr, cfg))
+		listeners = append(listeners, ln)
+	}
+
+	var tlsServer *http.Server
+	var tlsListener net.Listener
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			fmt.Println("Failed to load TLS certificate:", err)
+			os.Exit(1)
+		}
+		if cfg.TLSPort == "" {
+			cfg.TLSPort = "443"
+		}
+		tlsServer = newHTTPServer(":"+cfg.TLSPort, cfg)
+		tlsServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		tlsListener, err = listen(tlsServer.Addr, cfg)
+		if err != nil {
+			fmt.Println("Failed to listen on", tlsServer.Addr+":", err)
+			os.Exit(1)
+		}
 	}
-	accessLog := OpenLogFile(accessLogPath)
-	errorLog := OpenLogFile(errorLogPath)
+
+	accessLog := OpenLogTarget(cfg.AccessLog, cfg.MaxLogSize, cfg.MaxLogFiles, syslog.LOG_INFO|syslog.LOG_DAEMON)
+	errorLog := OpenLogTarget(cfg.ErrorLog, cfg.MaxLogSize, cfg.MaxLogFiles, syslog.LOG_ERR|syslog.LOG_DAEMON)
+	handlerLog := OpenLogTarget(cfg.HandlerLog, cfg.MaxLogSize, cfg.MaxLogFiles, syslog.LOG_NOTICE|syslog.LOG_DAEMON)
 	defer func() {
 		if accessLog != nil {
 			accessLog.Close()
@@ -265,101 +1394,107 @@ func main() {
 		if errorLog != nil {
 			errorLog.Close()
 		}
-	}()
-	accessLogger := log.New(accessLog, "", log.LstdFlags)
-	errorLogger := log.New(errorLog, "", log.LstdFlags)
-
-	handlerLogPath := "handler.log"
-	if cfg.HandlerLog != "" {
-		handlerLogPath = cfg.HandlerLog
-	}
-	handlerLog := OpenLogFile(handlerLogPath)
-	defer func() {
 		if handlerLog != nil {
 			handlerLog.Close()
 		}
 	}()
-	handlerLogger := log.New(handlerLog, "", log.LstdFlags)
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		filePath := cfg.HomeDir + r.URL.Path
-		logAccess := func(ww *StatusWriter) {
-			remoteHost := r.RemoteAddr
-			if idx := strings.LastIndex(remoteHost, ":"); idx != -1 {
-				remoteHost = remoteHost[:idx]
-			}
-			user := "-"
-			identd := "-"
-			timeStr := time.Now().Format("02/Jan/2006:15:04:05 -0700")
-			requestLine := fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Proto)
-			status := ww.Status
-			bytes := ww.Bytes
-			referer := r.Referer()
-			if referer == "" {
-				referer = "-"
-			}
-			userAgent := r.UserAgent()
-			if userAgent == "" {
-				userAgent = "-"
-			}
-			logMsg := fmt.Sprintf("%s %s %s [%s] \"%s\" %d %d \"%s\" \"%s\"", remoteHost, identd, user, timeStr, requestLine, status, bytes, referer, userAgent)
-			if accessLogger != nil {
-				accessLogger.Println(logMsg)
-			}
-		}
-		if stat, err := os.Stat(filePath); err == nil {
-			if stat.IsDir() {
-				ww := &StatusWriter{ResponseWriter: w, Status: 200}
-				if tryServeIndexWithHandler(ww, r, filePath, cfg.DefaultIndexes, cfg.Handlers) {
-					logAccess(ww)
-					return
-				}
-				// No index file found: show directory listing
-				RenderDirList(w, r, filePath, r.URL.Path)
-				return
-			}
-			ext := strings.ToLower(filepath.Ext(filePath))
-			if handler, ok := cfg.Handlers[ext]; ok {
-				ww := &StatusWriter{ResponseWriter: w, Status: 200}
-				handleWithExternal(ww, r, handler, filePath, handlerLogger)
-				if ww.Status >= 400 && errorLogger != nil {
-					errorLogger.Printf("%s %s %d %s", r.Method, r.URL.Path, ww.Status, r.RemoteAddr)
-				}
-				logAccess(ww)
-				return
-			}
-			ww := &StatusWriter{ResponseWriter: w, Status: 200}
-			http.ServeFile(ww, r, filePath)
-			logAccess(ww)
-			return
-		}
-		ww := &StatusWriter{ResponseWriter: w, Status: 404}
-		serveErrorPage(ww, 404, cfg.ErrorPages.NotFound, "404 page not found")
-		if errorLogger != nil {
-			errorLogger.Printf("%s %s %d %s", r.Method, r.URL.Path, ww.Status, r.RemoteAddr)
+	setLogTimes(cfg)
+	accessLogger := newLogger(accessLog)
+	errorLogger := newLogger(errorLog)
+	handlerLogger := newLogger(handlerLog)
+
+	server := NewServer(cfg, accessLogger, errorLogger, handlerLogger)
+	defer server.CloseRouteLogs()
+	for _, srv := range servers {
+		srv.Handler = server
+		if tlsServer != nil && cfg.RedirectHTTP {
+			srv.Handler = redirectToHTTPS(server)
 		}
-		logAccess(ww)
-	})
+	}
+	if tlsServer != nil {
+		tlsServer.Handler = server
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	go func() {
-		fmt.Printf("Serving %s on HTTP port: %s\n", cfg.HomeDir, cfg.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			fmt.Println("Server failed:", err)
-		}
-	}()
+	for i, srv := range servers {
+		fmt.Printf("Serving %s on HTTP address: %s\n", cfg.HomeDir, listeners[i].Addr())
+		go func(srv *http.Server, ln net.Listener) {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				fmt.Println("Server failed:", err)
+			}
+		}(srv, listeners[i])
+	}
+
+	if tlsServer != nil {
+		fmt.Printf("Serving %s on HTTPS address: %s\n", cfg.HomeDir, tlsListener.Addr())
+		go func() {
+			if err := tlsServer.ServeTLS(tlsListener, "", ""); err != nil && err != http.ErrServerClosed {
+				fmt.Println("TLS server failed:", err)
+			}
+		}()
+	}
 
-	<-quit
+	for running := true; running; {
+		select {
+		case <-hup:
+			newCfg, err := buildConfig(*configPath)
+			if err != nil {
+				fmt.Println("Config reload failed, keeping current config:", err)
+				errorLogger.Printf("config reload failed: %v", err)
+				continue
+			}
+			applyFlags(newCfg)
+			if problems, _ := validateConfig(newCfg); len(problems) > 0 {
+				fmt.Println("Config reload failed, keeping current config:", strings.Join(problems, "; "))
+				errorLogger.Printf("config reload failed: %s", strings.Join(problems, "; "))
+				continue
+			}
+			server.SetConfig(newCfg)
+			setLogTimes(newCfg)
+			resetDirTemplates()
+			server.CloseRouteLogs()
+			accessLog = ReopenLog(accessLogger, accessLog, newCfg.AccessLog, newCfg.MaxLogSize, newCfg.MaxLogFiles, syslog.LOG_INFO|syslog.LOG_DAEMON)
+			errorLog = ReopenLog(errorLogger, errorLog, newCfg.ErrorLog, newCfg.MaxLogSize, newCfg.MaxLogFiles, syslog.LOG_ERR|syslog.LOG_DAEMON)
+			handlerLog = ReopenLog(handlerLogger, handlerLog, newCfg.HandlerLog, newCfg.MaxLogSize, newCfg.MaxLogFiles, syslog.LOG_NOTICE|syslog.LOG_DAEMON)
+			fmt.Println("Config reloaded from", *configPath)
+		case <-quit:
+			shuttingDown.Store(true)
+			running = false
+		}
+	}
 	fmt.Println("\nShutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownStart := time.Now()
+	forced := false
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(server.Config().ShutdownTimeout)*time.Second)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		fmt.Println("Server forced to shutdown:", err)
-	} else {
-		fmt.Println("Server stopped gracefully.")
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Printf("Server on %s forced to shutdown: %v\n", srv.Addr, err)
+			forced = true
+		} else {
+			fmt.Printf("Server on %s stopped gracefully.\n", srv.Addr)
+		}
 	}
+	if tlsServer != nil {
+		if err := tlsServer.Shutdown(ctx); err != nil {
+			fmt.Println("TLS server forced to shutdown:", err)
+			forced = true
+		} else {
+			fmt.Println("TLS server stopped gracefully.")
+		}
+	}
+	if n := runningHandlers.drain(ctx); n > 0 {
+		fmt.Printf("Sent SIGTERM to %d handler process(es) still running.\n", n)
+		forced = true
+	}
+	outcome := "completed"
+	if forced {
+		outcome = "forced after the timeout"
+	}
+	fmt.Printf("Shutdown %s in %s.\n", outcome, time.Since(shutdownStart).Round(time.Millisecond))
 }
-
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolvePathTraversal(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		path   string
+		want   string // relative to root; "" when rejected
+		inside bool
+	}{
+		{"/", "", true},
+		{"/a/b.txt", "a/b.txt", true},
+		{"/a/../b.txt", "b.txt", true},
+		{"/a%20b.txt", "a b.txt", true},
+		{"/..", "", false},
+		{"/../etc/passwd", "", false},
+		{"/a/../../etc/passwd", "", false},
+		{"/%2e%2e/etc/passwd", "", false},
+		{"/%2E%2E%2Fetc/passwd", "", false},
+		{"/a/%2e%2e/%2e%2e/etc/passwd", "", false},
+		{"/..%2f..%2fetc/passwd", "", false},
+		{"/%zz", "", false},
+	}
+	for _, tt := range tests {
+		got, inside := resolvePath(root, tt.path, false)
+		if inside != tt.inside {
+			t.Errorf("resolvePath(%q): inside = %v, want %v", tt.path, inside, tt.inside)
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(tt.want)); inside && got != want {
+			t.Errorf("resolvePath(%q) = %q, want %q", tt.path, got, want)
+		}
+	}
+}
+
+func TestEscapingPathsGetNotFound(t *testing.T) {
+	s := testServer(t, `{"error_pages": {}}`, map[string]string{"404.html": "custom 404", "etc/passwd": "inside"})
+	s.Config().ErrorPages.NotFound = filepath.Join(s.Config().HomeDir, "404.html")
+	var errBuf bytes.Buffer
+	s.errorLogger = log.New(&errBuf, "", 0)
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/..%2f..%2fetc/passwd", 404},
+		{"/%2e%2e/etc/passwd", 404},
+		{"/%2E%2E%2Fetc/passwd", 404},
+		{"/../etc/passwd", 404},
+		{"/a/../../etc/passwd", 404},
+		{"/a/%2e%2e/%2e%2e/etc/passwd", 404},
+		// Unclean, but inside the root.
+		{"/a/../etc/passwd", 301},
+		{"/a/%2e%2e/etc/passwd", 301},
+	}
+	for _, tt := range tests {
+		errBuf.Reset()
+		w := serve(s, "GET", tt.target)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.target, w.Code, tt.code)
+			continue
+		}
+		if w.Header().Get("Server") == "" {
+			t.Errorf("%s: no Server header", tt.target)
+		}
+		if tt.code != 404 {
+			continue
+		}
+		if w.Body.String() != "custom 404" || w.Header().Get("Location") != "" {
+			t.Errorf("%s: got body %q to %q, want the 404 page", tt.target, w.Body.String(), w.Header().Get("Location"))
+		}
+		if !strings.Contains(errBuf.String(), "path escapes homedir") {
+			t.Errorf("%s: error log %q has no escape entry", tt.target, errBuf.String())
+		}
+	}
+}
+
+func TestResolvePathSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"in.txt":  filepath.Join(root, "a.txt"),
+		"rel.txt": "a.txt",
+		"out.txt": filepath.Join(outside, "secret"),
+		"outdir":  outside,
+		"up":      "..",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A root reached through a symlink is still the root.
+	linkedRoot := filepath.Join(t.TempDir(), "site")
+	if err := os.Symlink(root, linkedRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		root, path string
+		follow     bool
+		inside     bool
+	}{
+		{root, "/a.txt", false, true},
+		{root, "/in.txt", false, true},
+		{root, "/rel.txt", false, true},
+		{root, "/out.txt", false, false},
+		{root, "/outdir/secret", false, false},
+		{root, "/outdir/", false, false},
+		{root, "/up/", false, false},
+		{root, "/out.txt", true, true},
+		{root, "/outdir/secret", true, true},
+		{linkedRoot, "/a.txt", false, true},
+		{linkedRoot, "/in.txt", false, true},
+		{linkedRoot, "/out.txt", false, false},
+	}
+	for _, tt := range tests {
+		if _, inside := resolvePath(tt.root, tt.path, tt.follow); inside != tt.inside {
+			t.Errorf("resolvePath(%s, %q, follow=%v): inside = %v, want %v", tt.root, tt.path, tt.follow, inside, tt.inside)
+		}
+	}
+}
+
+func TestSymlinkOutsideHomedirIsForbidden(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, follow := range []bool{false, true} {
+		config := `{"follow_symlinks": false}`
+		want := 403
+		if follow {
+			config, want = `{"follow_symlinks": true}`, 200
+		}
+		s := testServer(t, config, map[string]string{"a.txt": "a"})
+		if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(s.Config().HomeDir, "out.txt")); err != nil {
+			t.Fatal(err)
+		}
+		if code := serve(s, "GET", "/out.txt").Code; code != want {
+			t.Errorf("follow_symlinks %v: got %d, want %d", follow, code, want)
+		}
+	}
+}
+
+func TestMimeTypeOverrides(t *testing.T) {
+	s := testServer(t, `{
+		"mime_types": {".wasm": "application/wasm", "webmanifest": "application/manifest+json", ".TXT": "text/x-custom"},
+		"default_indexes": ["index.webmanifest"]
+	}`, map[string]string{
+		"app.wasm":              "\x00asm",
+		"site.webmanifest":      "{}",
+		"notes.txt":             "notes",
+		"a.html":                "<p>",
+		"dir/index.webmanifest": "{}",
+	})
+	tests := map[string]string{
+		"/app.wasm":         "application/wasm",
+		"/site.webmanifest": "application/manifest+json",
+		"/notes.txt":        "text/x-custom",
+		"/a.html":           "text/html; charset=utf-8",
+		"/dir/":             "application/manifest+json",
+	}
+	for target, want := range tests {
+		w := serve(s, "GET", target)
+		if got := w.Header().Get("Content-Type"); w.Code != 200 || got != want {
+			t.Errorf("%s: got %d %q, want 200 %q", target, w.Code, got, want)
+		}
+	}
+}
+
+func TestConfigDirectoryMergePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"00-base.json": `{"homedir": "/srv/www", "port": "8080", "default_indexes": ["index.html", "index.php"],
+			"handlers": {".php": {"command": "php-cgi", "timeout": 10}},
+			"mounts": {"/docs/": {"root": "/srv/docs"}}}`,
+		"10-handlers.json": `{"handlers": {".php": {"timeout": 30}, ".sh": {"command": "/bin/sh"}},
+			"mounts": {"/files/": {"root": "/srv/files"}}}`,
+		"20-local.json": `{"port": "9090", "default_indexes": ["home.html"]}`,
+		"notes.txt":     `{"port": "1"}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := buildConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Later files replace scalars and arrays.
+	if cfg.Port != "9090" {
+		t.Errorf("port = %q, want the last file's 9090", cfg.Port)
+	}
+	if len(cfg.DefaultIndexes) != 1 || cfg.DefaultIndexes[0] != "home.html" {
+		t.Errorf("default_indexes = %q, want [home.html]", cfg.DefaultIndexes)
+	}
+	if cfg.HomeDir != "/srv/www" {
+		t.Errorf("homedir = %q, want /srv/www", cfg.HomeDir)
+	}
+	// Objects merge key by key, recursively.
+	if h := cfg.Handlers[".php"]; h.Command != "php-cgi" || h.Timeout != 30 {
+		t.Errorf(".php handler = %+v, want php-cgi with timeout 30", h)
+	}
+	if cfg.Handlers[".sh"].Command != "/bin/sh" {
+		t.Errorf(".sh handler missing: %+v", cfg.Handlers)
+	}
+	if cfg.Mounts["/docs/"].Root != "/srv/docs" || cfg.Mounts["/files/"].Root != "/srv/files" {
+		t.Errorf("mounts = %+v, want both /docs/ and /files/", cfg.Mounts)
+	}
+	// Settings no file mentions keep their defaults.
+	def := defaultConfig()
+	if cfg.LogFormat != def.LogFormat || cfg.ShutdownTimeout != def.ShutdownTimeout || cfg.HealthPath != def.HealthPath {
+		t.Errorf("defaults lost: log_format %q, shutdown_timeout %d, health_path %q",
+			cfg.LogFormat, cfg.ShutdownTimeout, cfg.HealthPath)
+	}
+}
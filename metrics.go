@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type MetricsConfig struct {
+	Enabled bool     `json:"enabled"`
+	Path    string   `json:"path"`  // default "/metrics"
+	Allow   []string `json:"allow"` // client CIDRs allowed to scrape; default loopback only
+}
+
+var defaultMetricsAllow = []string{"127.0.0.0/8", "::1/128"}
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// serverMetrics holds the counters exposed on the metrics endpoint.
+type serverMetrics struct {
+	mu            sync.Mutex
+	requests      uint64
+	statusClasses [6]uint64 // index 1-5 for 1xx-5xx; 0 for anything else
+	handlerRuns   uint64
+	handlerErrors uint64
+	inFlight      int64
+	overloaded    uint64 // requests refused by max_connections
+	buckets       []uint64
+	durationSum   float64
+}
+
+var metrics = &serverMetrics{buckets: make([]uint64, len(durationBuckets))}
+
+func (m *serverMetrics) observeRequest(status int, d time.Duration) {
+	secs := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	if class := status / 100; class >= 1 && class <= 5 {
+		m.statusClasses[class]++
+	} else {
+		m.statusClasses[0]++
+	}
+	for i, le := range durationBuckets {
+		if secs <= le {
+			m.buckets[i]++
+		}
+	}
+	m.durationSum += secs
+}
+
+// begin and end bracket a request so the in-flight gauge stays current.
+func (m *serverMetrics) begin() {
+	m.mu.Lock()
+	m.inFlight++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) end() {
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) observeOverload() {
+	m.mu.Lock()
+	m.overloaded++
+	m.mu.Unlock()
+}
+
+// observeHandler counts a handler invocation; statuses of 500 and above count
+// as handler errors.
+func (m *serverMetrics) observeHandler(status int, ran bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ran {
+		m.handlerRuns++
+	}
+	if status >= 500 {
+		m.handlerErrors++
+	}
+}
+
+// serveMetrics writes the counters in the Prometheus text exposition format.
+func serveMetrics(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	allow := cfg.Metrics.Allow
+	if len(allow) == 0 {
+		allow = defaultMetricsAllow
+	}
+	if !ipInPrefixes(requestClientIP(r), allow) {
+		serveErrorPage(w, cfg, http.StatusForbidden, "403 Forbidden")
+		return
+	}
+	m := metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintf(w, "# HELP webexec_requests_total Total HTTP requests served.\n# TYPE webexec_requests_total counter\nwebexec_requests_total %d\n", m.requests)
+	fmt.Fprintf(w, "# HELP webexec_responses_total HTTP responses by status class.\n# TYPE webexec_responses_total counter\n")
+	for class := 1; class <= 5; class++ {
+		fmt.Fprintf(w, "webexec_responses_total{class=\"%dxx\"} %d\n", class, m.statusClasses[class])
+	}
+	if m.statusClasses[0] > 0 {
+		fmt.Fprintf(w, "webexec_responses_total{class=\"other\"} %d\n", m.statusClasses[0])
+	}
+	fmt.Fprintf(w, "# HELP webexec_handler_runs_total External handler executions.\n# TYPE webexec_handler_runs_total counter\nwebexec_handler_runs_total %d\n", m.handlerRuns)
+	fmt.Fprintf(w, "# HELP webexec_handler_errors_total Handler requests that ended with a 5xx status.\n# TYPE webexec_handler_errors_total counter\nwebexec_handler_errors_total %d\n", m.handlerErrors)
+	fmt.Fprintf(w, "# HELP webexec_requests_in_flight Requests being served.\n# TYPE webexec_requests_in_flight gauge\nwebexec_requests_in_flight %d\n", m.inFlight)
+	fmt.Fprintf(w, "# HELP webexec_requests_rejected_total Requests refused with 503 because max_connections were in flight.\n# TYPE webexec_requests_rejected_total counter\nwebexec_requests_rejected_total %d\n", m.overloaded)
+	fmt.Fprintf(w, "# HELP webexec_request_duration_seconds Time taken to serve requests.\n# TYPE webexec_request_duration_seconds histogram\n")
+	for i, le := range durationBuckets {
+		fmt.Fprintf(w, "webexec_request_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), m.buckets[i])
+	}
+	fmt.Fprintf(w, "webexec_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.requests)
+	fmt.Fprintf(w, "webexec_request_duration_seconds_sum %g\nwebexec_request_duration_seconds_count %d\n", m.durationSum, m.requests)
+}
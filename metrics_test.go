@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsAllowUsesForwardedClient(t *testing.T) {
+	s := testServer(t, `{"metrics": {"enabled": true}, "trusted_proxies": ["127.0.0.1"]}`, nil)
+	tests := []struct {
+		remote, forwarded string
+		code              int
+	}{
+		{"127.0.0.1:4000", "", 200},
+		{"127.0.0.1:4000", "203.0.113.9", 403}, // an outside client behind the local proxy
+		{"127.0.0.1:4000", "127.0.0.1", 200},
+		{"203.0.113.9:4000", "127.0.0.1", 403}, // not a trusted proxy, so not believed
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("from %s for %q: got %d, want %d", tt.remote, tt.forwarded, w.Code, tt.code)
+		}
+	}
+}
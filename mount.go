@@ -0,0 +1,75 @@
+package main
+
+import "strings"
+
+// Mount serves the directory Root at a URL prefix in place of HomeDir. Empty
+// fields inherit the top-level (or virtual host) values.
+type Mount struct {
+	Root           string                   `json:"root"`
+	DefaultIndexes []string                 `json:"default_indexes"`
+	Handlers       map[string]HandlerConfig `json:"handlers"`
+	AccessLog      string                   `json:"access_log"` // separate access log for the mount, or "off"
+
+	ListingTitle      string `json:"listing_title"`
+	ListingHeaderHTML string `json:"listing_header_html"`
+	ListingFooterHTML string `json:"listing_footer_html"`
+}
+
+// mountConfig returns the config to use for urlPath: cfg itself, or a copy
+// rooted at the longest matching mount. "/static" also selects a "/static/"
+// mount so the directory redirect can happen.
+func mountConfig(cfg *Config, urlPath string) *Config {
+	prefix, m, ok := longestPrefix(cfg.Mounts, urlPath)
+	if !ok {
+		prefix, m, ok = longestPrefix(cfg.Mounts, urlPath+"/")
+	}
+	if !ok {
+		return cfg
+	}
+	c := *cfg
+	c.mount = strings.TrimSuffix(prefix, "/")
+	if m.Root != "" {
+		c.HomeDir = m.Root
+	}
+	if len(m.DefaultIndexes) > 0 {
+		c.DefaultIndexes = m.DefaultIndexes
+		c.IndexPaths = indexPathsWithin(c.IndexPaths, prefix)
+	}
+	if len(m.Handlers) > 0 {
+		c.Handlers = m.Handlers
+	}
+	if m.AccessLog != "" {
+		c.AccessLog = m.AccessLog
+	}
+	overrideListing(&c, m.ListingTitle, m.ListingHeaderHTML, m.ListingFooterHTML)
+	return &c
+}
+
+// indexPathsWithin keeps the index_paths entries for prefixes inside the
+// mount at prefix. Those for the mount's prefix or above it are less specific
+// than the mount's own default_indexes and would otherwise win over them.
+func indexPathsWithin(paths map[string][]string, prefix string) map[string][]string {
+	var within map[string][]string
+	for p, names := range paths {
+		if len(p) > len(prefix) && strings.HasPrefix(p, prefix) {
+			if within == nil {
+				within = make(map[string][]string)
+			}
+			within[p] = names
+		}
+	}
+	return within
+}
+
+// sitePath maps urlPath to a path inside cfg.HomeDir by removing the mount
+// prefix, if any.
+func sitePath(cfg *Config, urlPath string) string {
+	rest, ok := strings.CutPrefix(urlPath, cfg.mount)
+	if !ok {
+		return urlPath
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIndexNamesPrecedence(t *testing.T) {
+	cfg := &Config{
+		DefaultIndexes: []string{"index.html"},
+		IndexPaths: map[string][]string{
+			"/":        {"home.html"},
+			"/api/v2/": {"index.py"},
+			"/docs/":   {"README.html"},
+		},
+		Mounts: map[string]Mount{
+			"/api/":    {DefaultIndexes: []string{"index.cgi"}},
+			"/static/": {},
+		},
+		VirtualHosts: map[string]VirtualHost{
+			"own.example":   {IndexPaths: map[string][]string{"/app/": {"app.html"}}, DefaultIndexes: []string{"vhost.html"}},
+			"plain.example": {DefaultIndexes: []string{"vhost.html"}},
+		},
+	}
+	tests := []struct {
+		host, path string
+		want       string
+	}{
+		{"", "/", "home.html"},
+		{"", "/docs/", "README.html"},
+		{"", "/docs/guide/", "README.html"},
+		// The mount's default_indexes beat "/", which covers the whole mount,
+		{"", "/api/", "index.cgi"},
+		{"", "/api/v1/", "index.cgi"},
+		// but not prefixes inside the mount.
+		{"", "/api/v2/", "index.py"},
+		{"", "/api/v2/x/", "index.py"},
+		// A mount without default_indexes changes nothing.
+		{"", "/static/", "home.html"},
+		// A vhost's own index_paths replace the top-level ones,
+		{"own.example", "/app/", "app.html"},
+		{"own.example", "/", "vhost.html"},
+		{"own.example", "/docs/", "vhost.html"},
+		{"own.example", "/api/", "index.cgi"},
+		// otherwise they are inherited and still win over its default_indexes.
+		{"plain.example", "/", "home.html"},
+		{"plain.example", "/api/v2/", "index.py"},
+	}
+	for _, tt := range tests {
+		c := mountConfig(hostConfig(cfg, tt.host), tt.path)
+		if got := indexNames(c, tt.path); !slices.Equal(got, []string{tt.want}) {
+			t.Errorf("%s%s: got %v, want [%s]", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIndexPathsServeTheMostSpecificIndex(t *testing.T) {
+	s := testServer(t, `{"default_indexes": ["a.html"], "index_paths": {"/sub/": ["b.html"], "/sub/deep/": ["c.html", "a.html"]}}`,
+		map[string]string{
+			"a.html": "top a", "b.html": "top b",
+			"sub/a.html": "sub a", "sub/b.html": "sub b",
+			"sub/deep/a.html": "deep a", "sub/deep/b.html": "deep b",
+		})
+	for target, want := range map[string]string{"/": "top a", "/sub/": "sub b", "/sub/deep/": "deep a"} {
+		if w := serve(s, "GET", target); w.Code != 200 || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: got %d %q, want 200 %q", target, w.Code, w.Body.String(), want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var defaultPrecompressedExtensions = []string{".gz", ".br"}
+
+// precompressedCodings maps sibling file extensions to the content coding
+// they hold.
+var precompressedCodings = map[string]string{
+	".gz":  "gzip",
+	".br":  "br",
+	".zst": "zstd",
+}
+
+// encodingPreference returns the q-value the Accept-Encoding header gives
+// coding and the position of the entry that matched, so equal q-values can be
+// ordered as the client listed them. An explicit entry wins over "*".
+func encodingPreference(header, coding string) (q float64, pos int, ok bool) {
+	wildcard := false
+	var wq float64
+	var wpos int
+	for i, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		v := 1.0
+		if s, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				v = f
+			}
+		}
+		if strings.EqualFold(name, coding) {
+			return v, i, v > 0
+		}
+		if name == "*" && !wildcard {
+			wildcard, wq, wpos = true, v, i
+		}
+	}
+	return wq, wpos, wildcard && wq > 0
+}
+
+// precompressedVariant looks for a sibling of name in site with one of exts
+// whose coding the client accepts, preferring the highest q-value. It returns
+// the variant name and coding, or empty strings when the original should be
+// served.
+func precompressedVariant(w http.ResponseWriter, r *http.Request, site FileSystem, exts []string, name string) (string, string) {
+	header := r.Header.Get("Accept-Encoding")
+	var best, bestCoding string
+	bestQ, bestPos := 0.0, 0
+	found := false
+	for _, ext := range exts {
+		coding, known := precompressedCodings[strings.ToLower(ext)]
+		if !known {
+			continue
+		}
+		info, err := site.Stat(name + ext)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		found = true
+		q, pos, ok := encodingPreference(header, coding)
+		if !ok {
+			continue
+		}
+		if best == "" || q > bestQ || (q == bestQ && pos < bestPos) {
+			best, bestCoding, bestQ, bestPos = name+ext, coding, q, pos
+		}
+	}
+	if found {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	return best, bestCoding
+}
+
+// servePrecompressed sends variant as the encoded form of name, keeping the
+// Content-Type of the original file.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, cfg *Config, site FileSystem, name, variant, coding string) bool {
+	f, err := site.Open(variant)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			ctype = sniffContentType(site, name)
+		}
+		h.Set("Content-Type", ctype)
+	}
+	h.Set("Content-Encoding", coding)
+	if cfg.ETag {
+		if tag, err := fileETag(site, variant, info, cfg.ETagHashLimit); err == nil {
+			h.Set("ETag", tag)
+		}
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+	return true
+}
+
+// sniffContentType detects the type of the uncompressed file name from its
+// first 512 bytes.
+func sniffContentType(site FileSystem, name string) string {
+	f, err := site.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := f.Read(buf)
+	return http.DetectContentType(buf[:n])
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ProxyConfig struct {
+	Upstream    string `json:"upstream"`     // base URL, e.g. "http://127.0.0.1:3000/api"
+	StripPrefix bool   `json:"strip_prefix"` // drop the matched prefix before forwarding
+	Timeout     int    `json:"timeout"`      // seconds for connecting and for response headers; 0 means 30
+}
+
+// proxyTransports shares one transport per timeout so upstream connections are
+// reused across requests.
+var (
+	proxyTransportsMu sync.Mutex
+	proxyTransports   = make(map[int]*http.Transport)
+)
+
+func proxyTransport(timeout int) *http.Transport {
+	if timeout <= 0 {
+		timeout = 30
+	}
+	proxyTransportsMu.Lock()
+	defer proxyTransportsMu.Unlock()
+	if t, ok := proxyTransports[timeout]; ok {
+		return t
+	}
+	d := time.Duration(timeout) * time.Second
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: d, KeepAlive: 30 * time.Second}).DialContext,
+		ResponseHeaderTimeout: d,
+		TLSHandshakeTimeout:   d,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	}
+	proxyTransports[timeout] = t
+	return t
+}
+
+// serveProxy forwards r to the upstream configured for prefix and streams the
+// response back. Upstream failures answer 502.
+func serveProxy(w http.ResponseWriter, r *http.Request, cfg *Config, prefix string, pc ProxyConfig, errorLogger *log.Logger) {
+	target, err := url.Parse(pc.Upstream)
+	if err != nil || target.Host == "" {
+		LogRequestError(errorLogger, r, 502, fmt.Sprintf("invalid proxy upstream %q", pc.Upstream))
+		serveErrorPage(w, cfg, http.StatusBadGateway, "502 bad gateway")
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		if pc.StripPrefix {
+			req.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(prefix, "/")), "/")
+			req.URL.RawPath = ""
+		}
+		director(req)
+		req.Header.Set("X-Forwarded-Proto", requestScheme(r, cfg))
+		req.Header.Set("X-Forwarded-Host", r.Host)
+		req.Header.Set("X-Request-ID", requestID(r))
+	}
+	proxy.Transport = proxyTransport(pc.Timeout)
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		LogRequestError(errorLogger, r, 502, fmt.Sprintf("proxy to %s: %v", pc.Upstream, err))
+		serveErrorPage(w, cfg, http.StatusBadGateway, "502 bad gateway")
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyForwardsAnyMethod(t *testing.T) {
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Method
+	}))
+	defer upstream.Close()
+	s := testServer(t, `{"proxies": {"/api/": {"upstream": "`+upstream.URL+`"}}}`, map[string]string{"a.txt": "a"})
+
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE", "PATCH"} {
+		got = ""
+		w := serve(s, method, "/api/x")
+		if w.Code != 200 || got != method {
+			t.Errorf("%s /api/x: got %d, upstream saw %q", method, w.Code, got)
+		}
+	}
+	// Outside the proxy, allowed_methods still applies.
+	if w := serve(s, "PUT", "/a.txt"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT /a.txt: got %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseByteRange parses a single-range "bytes=" Range header against an entity
+// of the given size. ok is false when the header is not a single byte range
+// we understand, in which case the full entity should be sent. satisfiable is
+// false when the range lies entirely outside the entity.
+func parseByteRange(header string, size int64) (start, end int64, ok, satisfiable bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, false
+	}
+	if first == "" {
+		// suffix range: the final n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end, true, true
+}
+
+// validRange reports whether a "bytes=" Range header is well formed: a list
+// of "first-last", "first-" or "-suffix" specs with last >= first.
+func validRange(header string) bool {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return false
+	}
+	valid := false
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, found := strings.Cut(part, "-")
+		if !found || (first == "" && last == "") {
+			return false
+		}
+		var start, end int64
+		var err error
+		if first != "" {
+			if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+				return false
+			}
+		}
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < 0 {
+				return false
+			}
+			if first != "" && end < start {
+				return false
+			}
+		}
+		valid = true
+	}
+	return valid
+}
+
+// applyByteRange narrows a fully buffered body to the request's Range, setting
+// Content-Range and Content-Length, and returns the body and status to send.
+func applyByteRange(w http.ResponseWriter, r *http.Request, body []byte, status int) ([]byte, int) {
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" || status != http.StatusOK || r.Header.Get("If-Range") != "" {
+		return body, status
+	}
+	size := int64(len(body))
+	start, end, ok, satisfiable := parseByteRange(rangeHeader, size)
+	if !ok {
+		return body, status
+	}
+	if !satisfiable {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		w.Header().Del("Content-Length")
+		return nil, http.StatusRequestedRangeNotSatisfiable
+	}
+	w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	return body[start : end+1], http.StatusPartialContent
+}
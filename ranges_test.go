@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerByteRanges(t *testing.T) {
+	s := testServer(t, `{"handlers": {".sh": `+shHandler+`}}`, map[string]string{
+		"media.sh": "printf 'Content-Type: video/mp4\\nContent-Length: 10\\n\\n0123456789'",
+		"nolen.sh": "printf 'Content-Type: text/plain\\n\\n0123456789'",
+	})
+	tests := []struct {
+		target, rangeHeader string
+		code                int
+		contentRange, body  string
+	}{
+		{"/media.sh", "", 200, "", "0123456789"},
+		{"/media.sh", "bytes=2-5", 206, "bytes 2-5/10", "2345"},
+		{"/media.sh", "bytes=7-", 206, "bytes 7-9/10", "789"},
+		{"/media.sh", "bytes=-3", 206, "bytes 7-9/10", "789"},
+		{"/media.sh", "bytes=5-100", 206, "bytes 5-9/10", "56789"},
+		{"/media.sh", "bytes=10-20", 416, "bytes */10", ""},
+		{"/media.sh", "bytes=5-2", 416, "", "416 invalid range"},
+		// Without a Content-Length the handler's output isn't a definite
+		// entity, so the whole of it is sent.
+		{"/nolen.sh", "bytes=2-5", 200, "", "0123456789"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.rangeHeader != "" {
+			r.Header.Set("Range", tt.rangeHeader)
+		}
+		w := serveRequest(s, r)
+		if w.Code != tt.code || w.Header().Get("Content-Range") != tt.contentRange || w.Body.String() != tt.body {
+			t.Errorf("%s %s: got %d %q %q, want %d %q %q", tt.target, tt.rangeHeader,
+				w.Code, w.Header().Get("Content-Range"), w.Body.String(), tt.code, tt.contentRange, tt.body)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64  `json:"requests_per_second"` // 0 disables rate limiting
+	Burst             int      `json:"burst"`               // bucket size; defaults to 1
+	HandlersOnly      bool     `json:"handlers_only"`       // only limit requests routed to handlers
+	Exempt            []string `json:"exempt"`              // CIDR ranges that are never limited
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per client IP. Idle buckets are evicted
+// periodically so memory stays bounded by the number of active clients.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	startOnce sync.Once
+}
+
+var clientLimiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+const rateLimitIdle = 5 * time.Minute
+
+// allow takes a token for ip. When none is left it reports false and how long
+// until the next token is available.
+func (l *rateLimiter) allow(ip string, rate float64, burst int) (bool, time.Duration) {
+	l.startOnce.Do(func() { go l.evictLoop() })
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+func (l *rateLimiter) evictLoop() {
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-rateLimitIdle)
+		l.mu.Lock()
+		for ip, b := range l.buckets {
+			if b.last.Before(cutoff) {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// ipInPrefixes reports whether ip falls within any of the CIDR ranges.
+// Unparseable entries are ignored.
+func ipInPrefixes(ip string, cidrs []string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(c))
+		if err != nil {
+			if single, err := netip.ParseAddr(strings.TrimSpace(c)); err == nil && single.Unmap() == addr {
+				return true
+			}
+			continue
+		}
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the host part of r.RemoteAddr.
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// routeKind says which branch of the server answers a request.
+type routeKind int
+
+const (
+	routeNotFound routeKind = iota
+	routeForbidden
+	routeProxy
+	routeHandler
+	routeStatic
+	routeListing
+	routeRedirect
+	routeUnsupported
+)
+
+func (k routeKind) String() string {
+	switch k {
+	case routeForbidden:
+		return "forbidden"
+	case routeProxy:
+		return "proxy"
+	case routeHandler:
+		return "handler"
+	case routeStatic:
+		return "static file"
+	case routeListing:
+		return "directory listing"
+	case routeRedirect:
+		return "redirect"
+	case routeUnsupported:
+		return "unsupported media type"
+	}
+	return "not found"
+}
+
+// routeDecision is where routeRequest sends a request. Only the fields that
+// matter for Kind are set.
+type routeDecision struct {
+	Kind   routeKind
+	Via    string // how it was chosen, e.g. "path handler" or "index file"
+	Reason string // routeForbidden, routeNotFound, routeUnsupported: logged with the error
+
+	Prefix  string      // routeProxy: the matching prefix
+	Proxy   ProxyConfig // routeProxy
+	Handler HandlerConfig
+	Key     string // routeHandler: the handlers or path_handlers key
+
+	FilePath   string // file or directory on disk; empty for an embedded site
+	Name       string // routeStatic, routeListing: the path in the site
+	ScriptName string // routeHandler
+	PathInfo   string // routeHandler
+	Target     string // routeRedirect: the Location
+}
+
+// routeRequest works out how r is answered once the access checks have
+// passed, looking only at cfg and the site, never at the response. cfg is the
+// per-host, per-mount copy for r.
+func routeRequest(cfg *Config, r *http.Request) routeDecision {
+	if prefix, pc, ok := longestPrefix(cfg.Proxies, r.URL.Path); ok {
+		return routeDecision{Kind: routeProxy, Prefix: prefix, Proxy: pc}
+	}
+	filePath, ok := resolvePath(cfg.HomeDir, (&url.URL{Path: sitePath(cfg, r.URL.Path)}).EscapedPath(), cfg.FollowSymlinks)
+	if !ok {
+		return routeDecision{Kind: routeForbidden, Reason: "path escapes homedir"}
+	}
+	if hasHiddenComponent(cfg, r.URL.Path) {
+		return routeDecision{Kind: routeForbidden, Reason: "hidden path"}
+	}
+	if prefix, handler, ok := longestPrefix(cfg.PathHandlers, r.URL.Path); ok {
+		// A request the handler doesn't take, with no body to speak of,
+		// falls through to the files under the prefix, e.g. the form a
+		// JSON handler receives.
+		if contentTypeAllowed(handler, r) {
+			scriptName := strings.TrimSuffix(prefix, "/")
+			return routeDecision{Kind: routeHandler, Via: "path handler", Handler: handler, Key: prefix,
+				FilePath: filePath, ScriptName: scriptName, PathInfo: strings.TrimPrefix(r.URL.Path, scriptName)}
+		}
+		if r.Header.Get("Content-Type") != "" {
+			return unsupportedType(prefix, r)
+		}
+	}
+	site, name := siteFS(cfg), path.Clean(sitePath(cfg, r.URL.Path))
+	if isEmbedded(cfg) {
+		filePath = ""
+	}
+	if isIgnored(site, name) {
+		return routeDecision{Kind: routeNotFound, Reason: "ignored path"}
+	}
+	if stat, err := site.Stat(name); err == nil {
+		if stat.IsDir() {
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				// Redirect so relative links in the index or listing resolve
+				// inside the directory.
+				target := r.URL.EscapedPath() + "/"
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				return routeDecision{Kind: routeRedirect, Target: target}
+			}
+			if d, ok := findIndex(cfg, site, name, filePath, r.URL.Path); ok {
+				if d.Kind == routeHandler && !contentTypeAllowed(d.Handler, r) {
+					return unsupportedType(d.Key, r)
+				}
+				return d
+			}
+			if !autoIndexEnabled(cfg, r.URL.Path) {
+				return routeDecision{Kind: routeForbidden, Reason: "directory listing disabled"}
+			}
+			return routeDecision{Kind: routeListing, FilePath: filePath, Name: name}
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if handler, ok := cfg.Handlers[ext]; ok {
+			// Never fall back to serving the script itself, not even from
+			// an embedded site, where handlers don't run.
+			if filePath == "" {
+				return routeDecision{Kind: routeForbidden, Reason: "handler script in embedded site"}
+			}
+			if !contentTypeAllowed(handler, r) {
+				return unsupportedType(ext, r)
+			}
+			return routeDecision{Kind: routeHandler, Via: "extension handler", Handler: handler, Key: ext,
+				FilePath: filePath, ScriptName: r.URL.Path}
+		}
+		return routeDecision{Kind: routeStatic, FilePath: filePath, Name: name}
+	}
+	if scriptFile, scriptName, pathInfo, handler, ok := splitScriptPath(cfg, r.URL.Path); ok {
+		if !contentTypeAllowed(handler, r) {
+			return unsupportedType(strings.ToLower(path.Ext(scriptName)), r)
+		}
+		return routeDecision{Kind: routeHandler, Via: "script with path info", Handler: handler, Key: strings.ToLower(path.Ext(scriptName)),
+			FilePath: scriptFile, ScriptName: scriptName, PathInfo: pathInfo}
+	}
+	if d, ok := spaFallback(cfg, site, r); ok {
+		return d
+	}
+	return routeDecision{Kind: routeNotFound}
+}
+
+// viaSPAFallback marks the decision spaFallback makes; the response then
+// depends on Accept.
+const viaSPAFallback = "spa fallback"
+
+// spaFallback routes a request for a path that doesn't exist to the
+// spa_fallback file of the longest matching prefix, so a single-page app can
+// do its own routing. Only GET and HEAD requests that accept HTML qualify,
+// and paths whose last segment has an extension are left to 404 since they
+// look like missing assets.
+func spaFallback(cfg *Config, site FileSystem, r *http.Request) (routeDecision, bool) {
+	_, fallback, ok := longestPrefix(cfg.SPAFallback, r.URL.Path)
+	if !ok || fallback == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return routeDecision{}, false
+	}
+	if path.Ext(r.URL.Path) != "" || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return routeDecision{}, false
+	}
+	name := path.Clean(sitePath(cfg, fallback))
+	if stat, err := site.Stat(name); err != nil || stat.IsDir() || hasHiddenComponent(cfg, fallback) || isIgnored(site, name) {
+		return routeDecision{}, false
+	}
+	d := routeDecision{Kind: routeStatic, Via: viaSPAFallback, Name: name}
+	if !isEmbedded(cfg) {
+		if filePath, ok := resolvePath(cfg.HomeDir, (&url.URL{Path: sitePath(cfg, fallback)}).EscapedPath(), cfg.FollowSymlinks); ok {
+			d.FilePath = filePath
+		}
+	}
+	return d, true
+}
+
+// contentTypeAllowed reports whether handler takes requests with r's
+// Content-Type: any when content_types is empty, else one of the listed
+// media types, where "type/*" matches a whole type. Parameters such as
+// charset are ignored.
+func contentTypeAllowed(handler HandlerConfig, r *http.Request) bool {
+	if len(handler.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range handler.ContentTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedType is the decision for a request the handler under key
+// doesn't take.
+func unsupportedType(key string, r *http.Request) routeDecision {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "none"
+	}
+	return routeDecision{Kind: routeUnsupported, Key: key, Reason: fmt.Sprintf("content type %s not accepted by handler %s", contentType, key)}
+}
+
+// findIndex looks for the first index name (see indexNames) present in the
+// directory dirName of site, in the order configured, and routes to it: to
+// the extension's handler when one is configured, else as a static file.
+// dirPath is the directory on disk, or empty for an embedded site, where
+// handlers don't run and a handler index is refused rather than skipped. It
+// reports false when the directory has no index file.
+func findIndex(cfg *Config, site FileSystem, dirName, dirPath, urlPath string) (routeDecision, bool) {
+	ignored := ignoreRulesFor(site, dirName)
+	for _, idx := range indexNames(cfg, urlPath) {
+		if isHiddenName(cfg, idx) || ignored.ignores(path.Join(dirName, idx)) {
+			continue
+		}
+		indexName := path.Join(dirName, idx)
+		if stat, err := site.Stat(indexName); err == nil && !stat.IsDir() {
+			ext := strings.ToLower(path.Ext(idx))
+			if handler, ok := cfg.Handlers[ext]; ok {
+				if dirPath == "" {
+					return routeDecision{Kind: routeForbidden, Reason: "handler script in embedded site"}, true
+				}
+				return routeDecision{Kind: routeHandler, Via: "index file", Handler: handler, Key: ext,
+					FilePath: filepath.Join(dirPath, idx), ScriptName: path.Join(urlPath, idx)}, true
+			}
+			d := routeDecision{Kind: routeStatic, Via: "index file", Name: indexName}
+			if dirPath != "" {
+				d.FilePath = filepath.Join(dirPath, idx)
+			}
+			return d, true
+		}
+	}
+	return routeDecision{}, false
+}
+
+// printRoute describes to w how cfg routes a request with method to target,
+// which is a path or an absolute URL whose host picks the virtual host. It
+// is the -test-request mode and starts nothing.
+func printRoute(w io.Writer, cfg *Config, method, target string) error {
+	r, err := http.NewRequest(strings.ToUpper(method), target, nil)
+	if err != nil {
+		return err
+	}
+	r.RequestURI = r.URL.RequestURI()
+	r.Header.Set("Accept", "text/html") // as a browser navigating there would
+	fmt.Fprintf(w, "%s %s\n", r.Method, r.URL.Path)
+	if r.Host != "" {
+		fmt.Fprintf(w, "  host:        %s\n", r.Host)
+	}
+	// ServeHTTP answers these before anything else looks at the path.
+	if clean := cleanPath(r.URL.Path); clean != r.URL.Path && r.Method != http.MethodConnect {
+		if escapesRoot(r.URL.Path) {
+			fmt.Fprintf(w, "  route:       %s: path escapes homedir\n", routeNotFound)
+			return nil
+		}
+		fmt.Fprintf(w, "  route:       %s: unclean path\n", routeRedirect)
+		fmt.Fprintf(w, "  location:    %s\n", cleanTarget(r, clean))
+		return nil
+	}
+	cfg = mountConfig(hostConfig(cfg, r.Host), r.URL.Path)
+	if cfg.mount != "" {
+		fmt.Fprintf(w, "  mount:       %s -> %s\n", cfg.mount, cfg.HomeDir)
+	}
+	if allowed, ok := requestMethodAllowed(cfg, r); !ok {
+		fmt.Fprintf(w, "  route:       405 method not allowed (allowed: %s)\n", strings.Join(allowed, ", "))
+		return nil
+	}
+	d := routeRequest(cfg, r)
+	route := d.Kind.String()
+	if d.Via != "" {
+		route += " (" + d.Via + ")"
+	}
+	if d.Reason != "" {
+		route += ": " + d.Reason
+	}
+	fmt.Fprintf(w, "  route:       %s\n", route)
+	switch d.Kind {
+	case routeProxy:
+		fmt.Fprintf(w, "  upstream:    %s (prefix %s)\n", d.Proxy.Upstream, d.Prefix)
+	case routeHandler:
+		fmt.Fprintf(w, "  key:         %s\n", d.Key)
+		if d.Handler.Type == "fastcgi" {
+			fmt.Fprintf(w, "  fastcgi:     %s\n", d.Handler.Address)
+		} else {
+			fmt.Fprintf(w, "  command:     %s\n", resolveHandlerCommand(d.Handler.Command))
+		}
+		if !methodAllowed(d.Handler.Methods, r.Method) {
+			fmt.Fprintf(w, "  note:        the handler answers 405 (methods: %s)\n", strings.Join(d.Handler.Methods, ", "))
+		}
+		fmt.Fprintf(w, "  file:        %s\n", d.FilePath)
+		fmt.Fprintf(w, "  script_name: %s\n", d.ScriptName)
+		if d.PathInfo != "" {
+			fmt.Fprintf(w, "  path_info:   %s\n", d.PathInfo)
+		}
+	case routeStatic, routeListing:
+		if d.FilePath != "" {
+			fmt.Fprintf(w, "  file:        %s\n", d.FilePath)
+		} else {
+			fmt.Fprintf(w, "  embedded:    %s\n", d.Name)
+		}
+	case routeRedirect:
+		fmt.Fprintf(w, "  location:    %s\n", d.Target)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPrintRouteMatchesCleanPathHandling(t *testing.T) {
+	cfg := &Config{HomeDir: t.TempDir()}
+	tests := []struct {
+		target, route, location string
+	}{
+		{"/a/../admin/", "redirect: unclean path", "/admin/"},
+		{"/admin//x?y=1", "redirect: unclean path", "/admin/x?y=1"},
+		{"/..%2f..%2fetc/passwd", "not found: path escapes homedir", ""},
+		{"/admin/", "not found", ""},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := printRoute(&out, cfg, "GET", tt.target); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "route:       "+tt.route+"\n") {
+			t.Errorf("%s: output %q, want route %q", tt.target, out.String(), tt.route)
+		}
+		if got := strings.Contains(out.String(), "location:    "+tt.location+"\n"); got != (tt.location != "") {
+			t.Errorf("%s: output %q, want location %q", tt.target, out.String(), tt.location)
+		}
+	}
+}
+
+func TestDirectoryTrailingSlashRedirect(t *testing.T) {
+	s := testServer(t, `{"mounts": {"/static/": {}}}`, map[string]string{
+		"docs/a.txt":      "a",
+		"site/index.html": "index",
+		"a b/x.txt":       "x",
+	})
+	tests := []struct {
+		target, location string
+	}{
+		{"/docs", "/docs/"},
+		{"/docs?sort=size&order=desc", "/docs/?sort=size&order=desc"},
+		{"/site", "/site/"},
+		{"/a%20b", "/a%20b/"},
+		{"/static", "/static/"},
+	}
+	for _, tt := range tests {
+		w := serve(s, "GET", tt.target)
+		if w.Code != 301 || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s: got %d to %q, want 301 to %q", tt.target, w.Code, w.Header().Get("Location"), tt.location)
+		}
+	}
+	if w := serve(s, "GET", "/docs/"); w.Code != 200 || !strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("/docs/: got %d %q, want the listing", w.Code, w.Body.String())
+	}
+	if w := serve(s, "GET", "/site/"); w.Code != 200 || w.Body.String() != "index" {
+		t.Errorf("/site/: got %d %q, want the index", w.Code, w.Body.String())
+	}
+	if w := serve(s, "GET", "/docs/a.txt"); w.Code != 200 || w.Body.String() != "a" {
+		t.Errorf("/docs/a.txt: got %d %q, want the file", w.Code, w.Body.String())
+	}
+}
+
+func TestSPAFallbackServesShell(t *testing.T) {
+	s := testServer(t, `{"spa_fallback": {"/app/": "/app/index.html"}}`, map[string]string{
+		"app/index.html": "<p>shell</p>",
+		"app/data.txt":   "data",
+	})
+	html := "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8"
+	tests := []struct {
+		method, target, accept string
+		code                   int
+		body                   string
+	}{
+		{"GET", "/app/some/route", html, 200, "<p>shell</p>"},
+		{"HEAD", "/app/some/route", html, 200, ""},
+		{"GET", "/app/data.txt", html, 200, "data"},
+		{"GET", "/app/main.js", html, 404, ""},     // missing asset
+		{"GET", "/app/some/route", "*/*", 404, ""}, // not asking for HTML
+		{"POST", "/app/some/route", html, 404, ""}, // only GET and HEAD
+		{"GET", "/other/route", html, 404, ""},     // outside the prefix
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Header.Set("Accept", tt.accept)
+		w := serveRequest(s, r)
+		if w.Code != tt.code {
+			t.Errorf("%s %s (Accept %q): got %d, want %d", tt.method, tt.target, tt.accept, w.Code, tt.code)
+			continue
+		}
+		if tt.code != 200 {
+			continue
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s %s: body %q, want %q", tt.method, tt.target, w.Body.String(), tt.body)
+		}
+		fallback := tt.target == "/app/some/route"
+		if vary := slices.Contains(w.Header().Values("Vary"), "Accept"); vary != fallback {
+			t.Errorf("%s %s: Vary %q, want Accept only on the fallback", tt.method, tt.target, w.Header().Values("Vary"))
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/syslog"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server answers requests for the current config. main serves one on every
+// listener; SetConfig swaps the config in on reload without dropping
+// requests in flight.
+type Server struct {
+	cfg           atomic.Pointer[Config]
+	accessLogger  *log.Logger
+	errorLogger   *log.Logger
+	handlerLogger *log.Logger
+
+	routeLogsMu sync.Mutex
+	routeLogs   map[string]routeLog // access_log overrides of mounts and handlers, by target
+}
+
+// routeLog is an access log opened for a mount or handler override.
+type routeLog struct {
+	w      io.WriteCloser
+	logger *log.Logger
+}
+
+// NewServer returns a Server for cfg that logs to the given loggers.
+func NewServer(cfg *Config, accessLogger, errorLogger, handlerLogger *log.Logger) *Server {
+	s := &Server{accessLogger: accessLogger, errorLogger: errorLogger, handlerLogger: handlerLogger}
+	s.cfg.Store(cfg)
+	return s
+}
+
+// Config returns the config requests are currently served with.
+func (s *Server) Config() *Config {
+	return s.cfg.Load()
+}
+
+// SetConfig makes cfg the config for requests from now on.
+func (s *Server) SetConfig(cfg *Config) {
+	s.cfg.Store(cfg)
+}
+
+// accessLoggerFor returns the access logger for target, a mount's or
+// handler's access_log: the shared logger when target is empty or the
+// top-level log, nil for "off", else a log opened on first use.
+func (s *Server) accessLoggerFor(cfg *Config, target string) *log.Logger {
+	if target == "" || target == s.Config().AccessLog {
+		return s.accessLogger
+	}
+	if target == "off" {
+		return nil
+	}
+	s.routeLogsMu.Lock()
+	defer s.routeLogsMu.Unlock()
+	if l, ok := s.routeLogs[target]; ok {
+		return l.logger
+	}
+	w := OpenLogTarget(target, cfg.MaxLogSize, cfg.MaxLogFiles, syslog.LOG_INFO|syslog.LOG_DAEMON)
+	l := routeLog{w: w, logger: newLogger(w)}
+	if s.routeLogs == nil {
+		s.routeLogs = make(map[string]routeLog)
+	}
+	s.routeLogs[target] = l
+	return l.logger
+}
+
+// CloseRouteLogs closes the access logs opened for mount and handler
+// overrides. Later requests open them again, so calling it on reload picks
+// up rotated files and changed targets.
+func (s *Server) CloseRouteLogs() {
+	s.routeLogsMu.Lock()
+	defer s.routeLogsMu.Unlock()
+	for _, l := range s.routeLogs {
+		if l.w != nil {
+			l.w.Close()
+		}
+	}
+	s.routeLogs = nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metrics.begin()
+	defer metrics.end()
+	if clean := cleanPath(r.URL.Path); clean != r.URL.Path && r.Method != http.MethodConnect {
+		s.serveUncleanPath(w, r, clean)
+		return
+	}
+	cfg := mountConfig(hostConfig(s.Config(), r.Host), r.URL.Path)
+	logged := accessLogged(cfg, r.URL.Path)
+	accessLogger := s.accessLoggerFor(cfg, cfg.AccessLog)
+	if hw := (&StatusWriter{ResponseWriter: w, Status: 200, Start: time.Now()}); serveHealth(hw, cfg, r.URL.Path) {
+		if logged {
+			LogAccess(r, hw, accessLogger, cfg.LogFormat)
+		}
+		return
+	}
+	setServerHeader(w, cfg)
+	r = withRequestID(w, r)
+	ip := clientIP(r, cfg.TrustedProxies)
+	r = withClientIP(r, ip)
+	if cfg.Nosniff {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	applyCustomHeaders(w.Header(), cfg.Headers, r.URL.Path)
+	var tw *timeoutWriter
+	var deadline time.Time
+	if cfg.RequestTimeout > 0 {
+		timeout := time.Duration(cfg.RequestTimeout) * time.Second
+		deadline = time.Now().Add(timeout)
+		tw = newTimeoutWriter(w, cfg, timeout)
+		defer tw.stop()
+		w = tw
+	}
+	ww := &StatusWriter{ResponseWriter: w, Status: 200, Start: time.Now()}
+	var out http.ResponseWriter = ww
+	var gw *GzipWriter
+	if cfg.Compression.Enabled && acceptsEncoding(r, "gzip") {
+		gw = &GzipWriter{ResponseWriter: ww, cfg: &cfg.Compression, path: r.URL.Path}
+		out = gw
+	}
+	logAccess := func(ww *StatusWriter) {
+		if gw != nil {
+			gw.Close()
+		}
+		if tw != nil {
+			tw.stop()
+			if timedOut, answered, n := tw.result(); timedOut {
+				if answered {
+					ww.Status, ww.Bytes = http.StatusServiceUnavailable, n
+				}
+				LogRequestError(s.errorLogger, r, ww.Status, "request_timeout reached")
+			}
+		}
+		if logged {
+			LogAccess(r, ww, accessLogger, cfg.LogFormat)
+		}
+		metrics.observeRequest(ww.Status, time.Since(ww.Start))
+	}
+	if !ipAllowed(cfg, ip, r.URL.Path) {
+		drainBody(r)
+		serveErrorPage(out, cfg, 403, "403 Forbidden")
+		LogRequestError(s.errorLogger, r, ww.Status, "denied for "+ip)
+		logAccess(ww)
+		return
+	}
+	if cfg.Metrics.Enabled && r.URL.Path == cfg.Metrics.Path {
+		serveMetrics(ww, r, cfg)
+		logAccess(ww)
+		return
+	}
+	// Health checks and metrics above stay reachable when the server is full.
+	if limit := s.Config().MaxConnections; limit > 0 {
+		sem := getSemaphore("connections", limit)
+		if !sem.tryAcquire() {
+			metrics.observeOverload()
+			drainBody(r)
+			out.Header().Set("Retry-After", "1")
+			serveErrorPage(out, cfg, 503, "503 server busy")
+			LogRequestError(s.errorLogger, r, ww.Status, "max_connections reached")
+			logAccess(ww)
+			return
+		}
+		defer sem.release()
+	}
+	if file := shortcutFile(cfg, r.URL.Path); file != "" && serveShortcut(out, r, file) {
+		logAccess(ww)
+		return
+	}
+	if rl := cfg.RateLimit; rl.RequestsPerSecond > 0 && (!rl.HandlersOnly || isHandlerRoute(cfg, r.URL.Path)) {
+		if !ipInPrefixes(ip, rl.Exempt) {
+			if ok, wait := clientLimiter.allow(ip, rl.RequestsPerSecond, rl.Burst); !ok {
+				drainBody(r)
+				out.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				serveErrorPage(out, cfg, 429, "429 Too Many Requests")
+				LogRequestError(s.errorLogger, r, ww.Status, "rate limited")
+				logAccess(ww)
+				return
+			}
+		}
+	}
+	if handleCORS(out, r, &cfg.CORS) {
+		logAccess(ww)
+		return
+	}
+	if allowed, ok := requestMethodAllowed(cfg, r); !ok {
+		drainBody(r)
+		out.Header().Set("Allow", strings.ToUpper(strings.Join(allowed, ", ")))
+		out.WriteHeader(405)
+		out.Write([]byte("405 method not allowed"))
+		LogRequestError(s.errorLogger, r, ww.Status, "method not allowed")
+		logAccess(ww)
+		return
+	}
+	if !checkAuth(out, r, cfg, s.errorLogger) {
+		logAccess(ww)
+		return
+	}
+	d := routeRequest(cfg, r)
+	if d.Kind == routeHandler && d.Handler.AccessLog != "" {
+		accessLogger = s.accessLoggerFor(cfg, d.Handler.AccessLog)
+	}
+	if tw != nil {
+		// Proxied requests and streamed handler output may rightly run for
+		// long; proxies have their own timeout and handlers handler_timeout.
+		if d.Kind == routeProxy || (d.Kind == routeHandler && d.Handler.Stream) {
+			if !tw.stop() {
+				drainBody(r)
+				logAccess(ww)
+				return
+			}
+		} else {
+			// Handlers are killed and file reads abandoned when it passes.
+			ctx, cancel := context.WithDeadline(r.Context(), deadline)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+	}
+	if d.Kind == routeProxy {
+		serveProxy(ww, r, cfg, d.Prefix, d.Proxy, s.errorLogger)
+		logAccess(ww)
+		return
+	}
+	// Static files and handler output answer a malformed Range the same
+	// way, rather than one failing and the other ignoring it. Ranges in
+	// units other than bytes are ignored, as RFC 9110 asks.
+	if rh := r.Header.Get("Range"); rh != "" && !strings.HasPrefix(rh, "bytes=") {
+		r.Header.Del("Range")
+	} else if rh != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) && !validRange(rh) {
+		drainBody(r)
+		out.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		out.Write([]byte("416 invalid range"))
+		LogRequestError(s.errorLogger, r, ww.Status, "malformed Range header")
+		logAccess(ww)
+		return
+	}
+	switch d.Kind {
+	case routeForbidden:
+		drainBody(r)
+		serveErrorPage(out, cfg, 403, "403 Forbidden")
+		LogRequestError(s.errorLogger, r, ww.Status, d.Reason)
+	case routeRedirect:
+		http.Redirect(out, r, d.Target, http.StatusMovedPermanently)
+	case routeUnsupported:
+		drainBody(r)
+		serveErrorPage(out, cfg, http.StatusUnsupportedMediaType, "415 Unsupported Media Type")
+		LogRequestError(s.errorLogger, r, ww.Status, d.Reason)
+	case routeHandler:
+		handleWithExternal(out, r, cfg, d.Handler, d.Key, d.FilePath, d.ScriptName, d.PathInfo, s.handlerLogger)
+		if ww.Status >= 400 && !tw.answered503() {
+			LogRequestError(s.errorLogger, r, ww.Status, "")
+		}
+	case routeStatic:
+		if d.Via == viaSPAFallback {
+			out.Header().Add("Vary", "Accept")
+		}
+		serveStatic(out, r, cfg, siteFS(cfg), d.Name)
+	case routeListing:
+		RenderDirList(out, r, siteFS(cfg), d.FilePath, r.URL.Path, cfg, s.errorLogger)
+	default:
+		drainBody(r)
+		serveErrorPage(out, cfg, 404, "404 page not found")
+		LogRequestError(s.errorLogger, r, ww.Status, d.Reason)
+	}
+	logAccess(ww)
+}
+
+// cleanPath returns the canonical form of urlPath the way http.ServeMux
+// computes it: rooted, with "//", "." and ".." removed and a trailing slash
+// kept.
+func cleanPath(urlPath string) string {
+	if urlPath == "" {
+		return "/"
+	}
+	if urlPath[0] != '/' {
+		urlPath = "/" + urlPath
+	}
+	clean := path.Clean(urlPath)
+	if strings.HasSuffix(urlPath, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// escapesRoot reports whether urlPath climbs above "/" with "..", the way
+// "/../etc/passwd" or an encoded "/..%2fetc/passwd" does. resolvePath refuses
+// such a path under any root.
+func escapesRoot(urlPath string) bool {
+	depth := 0
+	for _, seg := range strings.Split(urlPath, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			if depth == 0 {
+				return true
+			}
+			depth--
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// cleanTarget is r's request URI with the path replaced by clean, keeping the
+// query.
+func cleanTarget(r *http.Request, clean string) string {
+	u := *r.URL
+	u.Path, u.RawPath = clean, ""
+	return u.RequestURI()
+}
+
+// serveUncleanPath answers a request for a path that isn't canonical. Auth,
+// ip_rules, mounts and the other prefix settings all match on the path, so
+// "//admin/" or "/x/../admin/" must never reach them: they get a 301 to
+// clean, as http.ServeMux did. A path that escapes the root gets the 404
+// page instead, and goes to the error log as an escape attempt.
+func (s *Server) serveUncleanPath(w http.ResponseWriter, r *http.Request, clean string) {
+	cfg := hostConfig(s.Config(), r.Host)
+	setServerHeader(w, cfg)
+	r = withRequestID(w, r)
+	r = withClientIP(r, clientIP(r, cfg.TrustedProxies))
+	ww := &StatusWriter{ResponseWriter: w, Status: 200, Start: time.Now()}
+	drainBody(r)
+	if escapesRoot(r.URL.Path) {
+		serveErrorPage(ww, cfg, 404, "404 page not found")
+		LogRequestError(s.errorLogger, r, ww.Status, "path escapes homedir")
+	} else {
+		http.Redirect(ww, r, cleanTarget(r, clean), http.StatusMovedPermanently)
+	}
+	if accessLogged(cfg, clean) {
+		LogAccess(r, ww, s.accessLoggerFor(cfg, cfg.AccessLog), cfg.LogFormat)
+	}
+	metrics.observeRequest(ww.Status, time.Since(ww.Start))
+}
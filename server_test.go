@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testServer writes files under a temporary home directory and returns a
+// Server for config, a JSON object to which the homedir is added.
+func testServer(t *testing.T, config string, files map[string]string) *Server {
+	t.Helper()
+	home := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(home, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config = strings.Replace(config, "{", `{"homedir": "`+home+`", `, 1)
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := buildConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(cfg, nil, nil, nil)
+}
+
+// serve sends one request to s and returns the recorded response.
+func serve(s *Server, method, target string) *httptest.ResponseRecorder {
+	return serveRequest(s, httptest.NewRequest(method, target, nil))
+}
+
+// serveRequest sends r, built by the caller with whatever headers or body it
+// needs, to s and returns the recorded response.
+func serveRequest(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// shHandler is a handler config that runs each script with /bin/sh.
+const shHandler = `{"command": "/bin/sh", "args": ["{filepath}"]}`
+
+func TestUncleanPathsAreRedirected(t *testing.T) {
+	s := testServer(t, `{
+		"auth": {"/admin/": {"users": {"alice": "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"}}},
+		"ip_rules": {"/pub/": {"deny": ["192.0.2.1"]}}
+	}`, map[string]string{"admin/s.txt": "secret", "pub/a.txt": "public", "zz/x": ""})
+
+	if code := serve(s, "GET", "/admin/s.txt").Code; code != 401 {
+		t.Fatalf("/admin/s.txt: got %d, want 401", code)
+	}
+	if code := serve(s, "GET", "/pub/a.txt").Code; code != 403 {
+		t.Fatalf("/pub/a.txt: got %d, want 403", code)
+	}
+	tests := []struct {
+		target, location string
+	}{
+		{"//admin/s.txt", "/admin/s.txt"},
+		{"/./admin/s.txt", "/admin/s.txt"},
+		{"/zz/../admin/s.txt", "/admin/s.txt"},
+		{"/admin//s.txt?x=1", "/admin/s.txt?x=1"},
+		{"//pub/a.txt", "/pub/a.txt"},
+		{"/./pub/a.txt", "/pub/a.txt"},
+		{"/zz/../pub/a.txt", "/pub/a.txt"},
+		{"/zz/..//admin/", "/admin/"},
+	}
+	for _, tt := range tests {
+		w := serve(s, "GET", tt.target)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s: got %d to %q, want 301 to %q", tt.target, w.Code, w.Header().Get("Location"), tt.location)
+		}
+		if strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "public") {
+			t.Errorf("%s: body leaks the file: %q", tt.target, w.Body.String())
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := map[string]string{
+		"":           "/",
+		"/":          "/",
+		"a/b":        "/a/b",
+		"/a//b/":     "/a/b/",
+		"/a/./b":     "/a/b",
+		"/a/../../b": "/b",
+		"/a/b/..":    "/a",
+		"/a/b/../":   "/a/",
+	}
+	for in, want := range tests {
+		if got := cleanPath(in); got != want {
+			t.Errorf("cleanPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEscapesRoot(t *testing.T) {
+	tests := map[string]bool{
+		"/":              false,
+		"/a/../b":        false,
+		"/a/./../b/..":   false,
+		"//a/..":         false,
+		"/..":            true,
+		"/../a":          true,
+		"/a/../../b":     true,
+		"/a/./.././../b": true,
+	}
+	for in, want := range tests {
+		if got := escapesRoot(in); got != want {
+			t.Errorf("escapesRoot(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestRedirectToHTTPSFollowsReload(t *testing.T) {
+	s := NewServer(&Config{TLSPort: "8443"}, nil, nil, nil)
+	h := redirectToHTTPS(s)
+	for _, tt := range []struct{ port, location string }{
+		{"8443", "https://example.com:8443/a?b=1"},
+		{"9443", "https://example.com:9443/a?b=1"},
+		{"443", "https://example.com/a?b=1"},
+	} {
+		s.SetConfig(&Config{TLSPort: tt.port})
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "http://example.com:8080/a?b=1", nil))
+		if got := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || got != tt.location {
+			t.Errorf("tls_port %s: got %d to %q, want 301 to %q", tt.port, w.Code, got, tt.location)
+		}
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	s := testServer(t, `{"handlers": {
+		".sh": `+shHandler+`,
+		".st": {"command": "/bin/sh", "args": ["{filepath}"], "stream": true}
+	}}`, map[string]string{
+		"a.txt": "static body",
+		"h.sh":  "printf 'Content-Type: text/plain\\nX-Handler: yes\\n\\nhandler body'",
+		"h.st":  "printf 'Content-Type: text/plain\\nX-Handler: yes\\n\\nstreamed body'",
+	})
+	tests := []struct {
+		target, contentLength, header string
+	}{
+		{"/a.txt", "11", ""},
+		{"/h.sh", "12", "yes"},
+		{"/h.st", "", "yes"},
+	}
+	for _, tt := range tests {
+		w := serve(s, "HEAD", tt.target)
+		if w.Code != 200 || w.Body.Len() != 0 {
+			t.Errorf("HEAD %s: got %d with %q, want 200 and no body", tt.target, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Length"); got != tt.contentLength {
+			t.Errorf("HEAD %s: Content-Length %q, want %q", tt.target, got, tt.contentLength)
+		}
+		if got := w.Header().Get("X-Handler"); got != tt.header {
+			t.Errorf("HEAD %s: X-Handler %q, want %q", tt.target, got, tt.header)
+		}
+		if w.Header().Get("Content-Type") == "" {
+			t.Errorf("HEAD %s: no Content-Type", tt.target)
+		}
+	}
+}
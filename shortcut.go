@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type cachedFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// shortcutFiles caches the favicon and robots.txt contents by path; they are
+// tiny and requested constantly.
+var (
+	shortcutMu    sync.Mutex
+	shortcutFiles = make(map[string]cachedFile)
+)
+
+// shortcutFile returns the file configured for urlPath ("/favicon.ico" or
+// "/robots.txt"), or "" to fall through to normal resolution.
+func shortcutFile(cfg *Config, urlPath string) string {
+	switch urlPath {
+	case "/favicon.ico":
+		return cfg.Favicon
+	case "/robots.txt":
+		return cfg.RobotsTxt
+	}
+	return ""
+}
+
+// serveShortcut serves the file at path from memory, reading it on first use.
+// It reports false when the file can't be read.
+func serveShortcut(w http.ResponseWriter, r *http.Request, path string) bool {
+	shortcutMu.Lock()
+	f, ok := shortcutFiles[path]
+	if !ok {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			shortcutMu.Unlock()
+			return false
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			shortcutMu.Unlock()
+			return false
+		}
+		f = cachedFile{data: data, modTime: info.ModTime()}
+		shortcutFiles[path] = f
+	}
+	shortcutMu.Unlock()
+	http.ServeContent(w, r, path, f.modTime, bytes.NewReader(f.data))
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileSystem is the view of the site that static files, index files and
+// directory listings are read from. Names are slash-separated and rooted at
+// the site, e.g. "/docs/a.txt"; implementations must not let a name escape
+// the root.
+type FileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	Open(name string) (http.File, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// osFS serves the directory tree at root.
+type osFS struct {
+	root string
+}
+
+func (o osFS) path(name string) string {
+	return filepath.Join(o.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (o osFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(o.path(name)) }
+
+func (o osFS) Open(name string) (http.File, error) { return os.Open(o.path(name)) }
+
+func (o osFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(o.path(name)) }
+
+// ioFS adapts an fs.FS, such as the embedded site, to FileSystem.
+type ioFS struct {
+	fsys fs.FS
+}
+
+func (f ioFS) name(name string) string {
+	if name = strings.TrimPrefix(path.Clean("/"+name), "/"); name == "" {
+		return "."
+	}
+	return name
+}
+
+func (f ioFS) Stat(name string) (fs.FileInfo, error) { return fs.Stat(f.fsys, f.name(name)) }
+
+func (f ioFS) Open(name string) (http.File, error) { return http.FS(f.fsys).Open(f.name(name)) }
+
+func (f ioFS) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(f.fsys, f.name(name)) }
+
+// embedPrefix marks a HomeDir that serves the files compiled into the binary
+// instead of a directory on disk: "embed:" serves the whole site/ tree and
+// "embed:docs" serves site/docs.
+const embedPrefix = "embed:"
+
+func isEmbedded(cfg *Config) bool {
+	return strings.HasPrefix(cfg.HomeDir, embedPrefix)
+}
+
+// embeddedSubs holds the ioFS for each embedded HomeDir. fs.Sub returns a
+// new value every time, and the ETag and ignore caches are keyed on the
+// FileSystem, so each one is built once; the embedded files never change.
+var embeddedSubs sync.Map // sub path -> ioFS
+
+// siteFS returns the filesystem static files, index files and directory
+// listings are read from. Handlers always run against the real filesystem.
+func siteFS(cfg *Config) FileSystem {
+	if sub, ok := strings.CutPrefix(cfg.HomeDir, embedPrefix); ok {
+		dir := path.Join("site", path.Clean("/"+sub))
+		if site, ok := embeddedSubs.Load(dir); ok {
+			return site.(ioFS)
+		}
+		site := ioFS{embeddedSite}
+		if fsys, err := fs.Sub(embeddedSite, dir); err == nil {
+			site = ioFS{fsys}
+		}
+		actual, _ := embeddedSubs.LoadOrStore(dir, site)
+		return actual.(ioFS)
+	}
+	return osFS{cfg.HomeDir}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSiteFSIsStableForEmbeddedSites(t *testing.T) {
+	for _, home := range []string{"embed:", "embed:docs"} {
+		cfg := &Config{HomeDir: home}
+		if siteFS(cfg) != siteFS(cfg) {
+			t.Errorf("%s: siteFS returned a different FileSystem for the same config", home)
+		}
+	}
+	if a, b := siteFS(&Config{HomeDir: "embed:a"}), siteFS(&Config{HomeDir: "embed:b"}); a == b {
+		t.Errorf("different embedded directories share a FileSystem")
+	}
+}
+
+func TestEmbeddedHandlerScriptsAreNotServed(t *testing.T) {
+	// Stand in for site/t in an embedsite build.
+	embeddedSubs.Store("site/t", ioFS{fstest.MapFS{
+		"app.php":          {Data: []byte("<?php secret(); ?>")},
+		"a.txt":            {Data: []byte("static")},
+		"dir/index.php":    {Data: []byte("<?php secret(); ?>")},
+		"dir/index.html":   {Data: []byte("index")},
+		"plain/index.html": {Data: []byte("index")},
+	}})
+	defer embeddedSubs.Delete("site/t")
+	cfg := &Config{
+		HomeDir:        "embed:t",
+		DefaultIndexes: []string{"index.php", "index.html"},
+		Handlers:       map[string]HandlerConfig{".php": {Command: "php-cgi"}},
+	}
+	tests := []struct {
+		target string
+		kind   routeKind
+	}{
+		{"/a.txt", routeStatic},
+		{"/app.php", routeForbidden},
+		{"/dir/", routeForbidden},
+		{"/plain/", routeStatic},
+	}
+	for _, tt := range tests {
+		if d := routeRequest(cfg, httptest.NewRequest("GET", tt.target, nil)); d.Kind != tt.kind {
+			t.Errorf("%s: routed to %v (%s), want %v", tt.target, d.Kind, d.Reason, tt.kind)
+		}
+	}
+}
+
+func TestEmbedSiteTagBuilds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the binary")
+	}
+	goTool := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(goTool); err != nil {
+		t.Skip("go tool not found")
+	}
+	cmd := exec.Command(goTool, "build", "-tags", "embedsite", "-o", os.DevNull, ".")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build -tags embedsite: %v\n%s", err, out)
+	}
+}
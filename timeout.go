@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// timeoutWriter enforces request_timeout. Unlike http.TimeoutHandler it
+// doesn't buffer the response, so files still go out with sendfile and
+// handler output is still flushed as it comes. If the deadline passes before
+// the response has started, the client gets a 503 at once and whatever the
+// request writes afterwards is dropped; if it has started, writes to the
+// connection are cut off so a slow client can't hold the request open.
+type timeoutWriter struct {
+	w     http.ResponseWriter
+	h     http.Header // the request's headers until the response starts
+	timer *time.Timer
+
+	mu          sync.Mutex
+	wroteHeader bool
+	stopped     bool // stop won; an expire that was already due does nothing
+	timedOut    bool
+	answered    bool  // the 503 page went out
+	bytes       int64 // of the 503 page
+}
+
+// newTimeoutWriter wraps w, answering with the 503 page of cfg if the
+// response hasn't started when timeout has passed. The caller must call stop
+// once the request is done.
+func newTimeoutWriter(w http.ResponseWriter, cfg *Config, timeout time.Duration) *timeoutWriter {
+	tw := &timeoutWriter{w: w, h: w.Header().Clone()}
+	tw.timer = time.AfterFunc(timeout, func() { tw.expire(cfg) })
+	return tw
+}
+
+func (tw *timeoutWriter) expire(cfg *Config) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.stopped {
+		return
+	}
+	tw.timedOut = true
+	rc := http.NewResponseController(tw.w)
+	if tw.wroteHeader {
+		rc.SetWriteDeadline(time.Now())
+		return
+	}
+	tw.wroteHeader, tw.answered = true, true
+	body := errorPageBody(cfg, http.StatusServiceUnavailable, "503 request timed out")
+	h := tw.w.Header()
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	// The request may carry on until it notices the cancelled context, and
+	// the connection can't be reused until it has.
+	h.Set("Connection", "close")
+	tw.w.WriteHeader(http.StatusServiceUnavailable)
+	n, _ := tw.w.Write(body)
+	tw.bytes = int64(n)
+	rc.Flush()
+}
+
+// stop disarms the timeout, for routes exempt from it and once the request
+// is done. It reports false when the timeout has already fired, and then
+// returns only once expire is done with the response, so the caller can log
+// it and return from ServeHTTP.
+func (tw *timeoutWriter) stop() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return false
+	}
+	// expire holds mu while it runs, so it either hasn't started and now
+	// never will, or it has finished.
+	tw.stopped = true
+	tw.timer.Stop()
+	return true
+}
+
+// result reports whether the timeout fired and whether that was in time to
+// answer with the 503 page, of which n bytes were sent.
+func (tw *timeoutWriter) result() (timedOut, answered bool, n int64) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.timedOut, tw.answered, tw.bytes
+}
+
+// answered503 reports whether tw, if any, has sent the 503 page, so what the
+// request itself ended with never reached the client.
+func (tw *timeoutWriter) answered503() bool {
+	if tw == nil {
+		return false
+	}
+	_, answered, _ := tw.result()
+	return answered
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		return
+	}
+	dst := tw.w.Header()
+	clear(dst)
+	maps.Copy(dst, tw.h)
+	if code >= 200 {
+		tw.wroteHeader = true
+	}
+	tw.w.WriteHeader(code)
+}
+
+// start sends the status line if nothing has been sent yet, and reports
+// false once the timeout has fired.
+func (tw *timeoutWriter) start() bool {
+	tw.mu.Lock()
+	started := tw.wroteHeader
+	tw.mu.Unlock()
+	if !started {
+		tw.WriteHeader(http.StatusOK)
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return !tw.timedOut
+}
+
+// Write and ReadFrom don't hold the lock while writing, so that expire can
+// cut off a write that is stuck on a slow client.
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if !tw.start() {
+		return 0, http.ErrHandlerTimeout
+	}
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !tw.start() {
+		return 0, http.ErrHandlerTimeout
+	}
+	if rf, ok := tw.w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(tw.w, src)
+}
+
+func (tw *timeoutWriter) FlushError() error {
+	if !tw.start() {
+		return http.ErrHandlerTimeout
+	}
+	return http.NewResponseController(tw.w).Flush()
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	s := testServer(t, `{
+		"request_timeout": 1,
+		"handlers": {
+			".sh": {"command": "/bin/sh", "args": ["{filepath}"]},
+			".stream": {"command": "/bin/sh", "args": ["{filepath}"], "stream": true}
+		}
+	}`, map[string]string{
+		"a.txt":       "static",
+		"fast.sh":     "printf 'Content-Type: text/plain\\n\\nfast'",
+		"slow.sh":     "sleep 5; printf 'Content-Type: text/plain\\n\\nslow'",
+		"long.stream": "sleep 1.5; printf 'Content-Type: text/plain\\n\\nlong'",
+	})
+	tests := []struct {
+		target string
+		code   int
+		body   string
+		within time.Duration
+	}{
+		{"/a.txt", 200, "static", time.Second},
+		{"/fast.sh", 200, "fast", time.Second},
+		// Killed at the deadline instead of running its 5s.
+		{"/slow.sh", 503, "", 3 * time.Second},
+		// Streaming handlers are exempt and may outlive the timeout.
+		{"/long.stream", 200, "long", 4 * time.Second},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		w := serve(s, "GET", tt.target)
+		d := time.Since(start)
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.target, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+		if d > tt.within {
+			t.Errorf("%s: took %s, want under %s", tt.target, d, tt.within)
+		}
+	}
+}
+
+func TestTimeoutWriterStopWaitsForExpire(t *testing.T) {
+	cfg := &Config{}
+	for i := range 200 {
+		rec := httptest.NewRecorder()
+		tw := newTimeoutWriter(rec, cfg, time.Duration(i%20)*time.Microsecond)
+		time.Sleep(10 * time.Microsecond)
+		stopped := tw.stop()
+		timedOut, answered, n := tw.result()
+		if stopped == timedOut {
+			t.Fatalf("stop() = %v but timed out = %v", stopped, timedOut)
+		}
+		if !stopped && (!answered || n != int64(rec.Body.Len()) || rec.Code != 503) {
+			t.Fatalf("stop returned before the 503 was written: answered %v, %d of %d bytes, code %d", answered, n, rec.Body.Len(), rec.Code)
+		}
+		if tw.stop() != stopped {
+			t.Fatal("a second stop disagrees with the first")
+		}
+		if stopped {
+			time.Sleep(30 * time.Microsecond)
+			if timedOut, _, _ := tw.result(); timedOut || rec.Body.Len() != 0 {
+				t.Fatalf("the timeout fired after stop won")
+			}
+		}
+	}
+}
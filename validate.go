@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateConfig checks cfg for mistakes that would only show up once
+// requests arrive. Problems stop the server from starting; warnings are
+// printed but the server starts anyway.
+func validateConfig(cfg *Config) (problems, warnings []string) {
+	checkDir := func(what, dir string) {
+		if dir == "" || strings.HasPrefix(dir, embedPrefix) {
+			return
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: %v", what, dir, err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s %s is not a directory", what, dir))
+		}
+	}
+	checkHandlers := func(what string, handlers map[string]HandlerConfig) {
+		keys := make([]string, 0, len(handlers))
+		for k := range handlers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			h := handlers[k]
+			if h.Type == "fastcgi" {
+				if h.Address == "" {
+					problems = append(problems, fmt.Sprintf("%s %q: fastcgi handler has no address", what, k))
+				}
+				continue
+			}
+			if cmd := resolveHandlerCommand(h.Command); !isExecutable(cmd) {
+				warnings = append(warnings, fmt.Sprintf("%s %q: command %s is missing or not executable", what, k, cmd))
+			}
+		}
+	}
+
+	checkErrorPages := func(what string, pages map[string]string) {
+		for code := range pages {
+			if n, err := strconv.Atoi(code); err != nil || n < 400 || n > 599 {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a 4xx or 5xx status code", what, code))
+			}
+		}
+	}
+
+	checkDir("homedir", cfg.HomeDir)
+	checkErrorPages("error_pages_map", cfg.ErrorPagesMap)
+	checkHandlers("handler", cfg.Handlers)
+	checkHandlers("path handler", cfg.PathHandlers)
+	for prefix, m := range cfg.Mounts {
+		checkDir("mount "+prefix+" root", m.Root)
+		checkHandlers("mount "+prefix+" handler", m.Handlers)
+	}
+	for host, vh := range cfg.VirtualHosts {
+		checkDir("virtual host "+host+" homedir", vh.HomeDir)
+		checkHandlers("virtual host "+host+" handler", vh.Handlers)
+		checkErrorPages("virtual host "+host+" error_pages_map", vh.ErrorPagesMap)
+	}
+	if f := cfg.HandlerLogFormat; f != "" && f != "text" && f != "json" {
+		problems = append(problems, fmt.Sprintf("handler_log_format %q: must be text or json", f))
+	}
+	if f := cfg.LogTimeFormat; f != "" && logTimeLayouts[strings.ToLower(f)] == "" {
+		// A layout with no reference-time fields prints itself verbatim.
+		if (time.Time{}).Format(f) == f {
+			problems = append(problems, fmt.Sprintf("log_time_format %q: not a known name or a Go time layout", f))
+		}
+	}
+	if cfg.CORS.AllowCredentials && slices.Contains(cfg.CORS.AllowedOrigins, "*") {
+		// Every origin would be reflected with credentials allowed, handing
+		// any site the responses a logged-in user gets.
+		problems = append(problems, `cors: allow_credentials can't be used with "*" in allowed_origins; list the origins instead`)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		problems = append(problems, "both tls_cert and tls_key must be set to enable TLS")
+	}
+	sort.Strings(problems)
+	return problems, warnings
+}
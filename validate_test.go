@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRejectsWildcardCORSWithCredentials(t *testing.T) {
+	tests := []struct {
+		cors CORSConfig
+		ok   bool
+	}{
+		{CORSConfig{AllowedOrigins: []string{"*"}}, true},
+		{CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}, true},
+		{CORSConfig{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true}, true},
+		{CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, false},
+		{CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}, false},
+	}
+	for _, tt := range tests {
+		problems, _ := validateConfig(&Config{CORS: tt.cors})
+		rejected := false
+		for _, p := range problems {
+			rejected = rejected || strings.HasPrefix(p, "cors:")
+		}
+		if rejected == tt.ok {
+			t.Errorf("%+v: problems %q, want ok = %v", tt.cors, problems, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// VirtualHost overrides parts of the top-level config for one hostname.
+// Empty fields inherit the top-level values.
+type VirtualHost struct {
+	HomeDir        string                   `json:"homedir"`
+	DefaultIndexes []string                 `json:"default_indexes"`
+	IndexPaths     map[string][]string      `json:"index_paths"` // replaces the top-level index_paths
+	Handlers       map[string]HandlerConfig `json:"handlers"`
+	ErrorPages     ErrorPages               `json:"error_pages"`
+	ErrorPagesMap  map[string]string        `json:"error_pages_map"`
+
+	ListingTitle      string `json:"listing_title"`
+	ListingHeaderHTML string `json:"listing_header_html"`
+	ListingFooterHTML string `json:"listing_footer_html"`
+}
+
+// matchVirtualHost finds the entry for host (port stripped, case-insensitive).
+// An exact name wins; otherwise the longest "*.domain" wildcard covering a
+// subdomain of host is used.
+func matchVirtualHost(hosts map[string]VirtualHost, host string) (VirtualHost, bool) {
+	if len(hosts) == 0 {
+		return VirtualHost{}, false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	var best string
+	var match VirtualHost
+	for name, vh := range hosts {
+		name = strings.ToLower(name)
+		if name == host {
+			return vh, true
+		}
+		if suffix, ok := strings.CutPrefix(name, "*"); ok && strings.HasPrefix(suffix, ".") &&
+			strings.HasSuffix(host, suffix) && len(host) > len(suffix) && len(name) > len(best) {
+			best, match = name, vh
+		}
+	}
+	return match, best != ""
+}
+
+// hostConfig returns the config to use for a request to host: cfg itself, or
+// a copy with the matching virtual host's overrides applied.
+func hostConfig(cfg *Config, host string) *Config {
+	vh, ok := matchVirtualHost(cfg.VirtualHosts, host)
+	if !ok {
+		return cfg
+	}
+	c := *cfg
+	if vh.HomeDir != "" {
+		c.HomeDir = vh.HomeDir
+	}
+	if len(vh.DefaultIndexes) > 0 {
+		c.DefaultIndexes = vh.DefaultIndexes
+	}
+	if len(vh.IndexPaths) > 0 {
+		c.IndexPaths = vh.IndexPaths
+	}
+	if len(vh.Handlers) > 0 {
+		c.Handlers = vh.Handlers
+	}
+	if len(vh.ErrorPagesMap) > 0 {
+		pages := make(map[string]string, len(c.ErrorPagesMap)+len(vh.ErrorPagesMap))
+		for code, page := range c.ErrorPagesMap {
+			pages[code] = page
+		}
+		for code, page := range vh.ErrorPagesMap {
+			pages[code] = page
+		}
+		c.ErrorPagesMap = pages
+	}
+	overrideListing(&c, vh.ListingTitle, vh.ListingHeaderHTML, vh.ListingFooterHTML)
+	if vh.ErrorPages.NotFound != "" {
+		c.ErrorPages.NotFound = vh.ErrorPages.NotFound
+	}
+	if vh.ErrorPages.Internal != "" {
+		c.ErrorPages.Internal = vh.ErrorPages.Internal
+	}
+	if vh.ErrorPages.Forbidden != "" {
+		c.ErrorPages.Forbidden = vh.ErrorPages.Forbidden
+	}
+	if vh.ErrorPages.ServiceUnavailable != "" {
+		c.ErrorPages.ServiceUnavailable = vh.ErrorPages.ServiceUnavailable
+	}
+	return &c
+}
+
+// overrideListing applies the listing branding fields a virtual host or
+// mount sets, leaving the inherited ones where it sets none.
+func overrideListing(c *Config, title, header, footer string) {
+	if title != "" {
+		c.ListingTitle = title
+	}
+	if header != "" {
+		c.ListingHeaderHTML = header
+	}
+	if footer != "" {
+		c.ListingFooterHTML = footer
+	}
+}